@@ -13,6 +13,8 @@ func main() {
 	app.Commands = []*cli.Command{
 		cmds.NewServerCommand(),
 		cmds.NewAgentCommand(),
+		cmds.NewPrepareRuntimeCommand(),
+		cmds.NewCheckRuntimeCommand(),
 	}
 
 	if err := app.Run(os.Args); err != nil {
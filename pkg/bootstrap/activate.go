@@ -0,0 +1,171 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ActivateRuntime makes the already staged runtime data dir named dataName the
+// active runtime, as Stage does. If the data dir bin path is a real directory
+// the binaries are copied into it, as with StageOptions.CopyBinaries. The
+// returned function reactivates the runtime that was active before, or
+// removes the bin path if there was none, so that an upgrade can be rolled
+// back if the new runtime misbehaves.
+func ActivateRuntime(dataDir, dataName string) (func() error, error) {
+	binDir := dataDirFor(dataDir, dataName)
+	if !dirExists(binDir) {
+		return nil, fmt.Errorf("runtime %s is not staged in %s", dataName, dataDir)
+	}
+
+	unlock, err := lockDataDir(dataDir, StageOptions{}.lockTimeout())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	link := symlinkBinDir(dataDir)
+	previous, err := ResolveActiveBinDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	opts := StageOptions{}
+	if fi, err := os.Lstat(link); err == nil && fi.IsDir() {
+		opts.CopyBinaries = true
+	}
+
+	if err := linkBinDir(dataDir, binDir, opts); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		unlock, err := lockDataDir(dataDir, StageOptions{}.lockTimeout())
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if previous == "" {
+			if err := os.Remove(activePointerFile(dataDir)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return os.RemoveAll(link)
+		}
+		return linkBinDir(dataDir, previous, opts)
+	}, nil
+}
+
+// ResolveActiveBinDir returns the bin dir of the active runtime in dataDir:
+// the target of the bin symlink or, if there is no symlink, the bin dir
+// recorded when it could not be created or was copied instead. It returns an
+// empty string if no runtime is active.
+func ResolveActiveBinDir(dataDir string) (string, error) {
+	link := symlinkBinDir(dataDir)
+	fi, err := os.Lstat(link)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return os.Readlink(link)
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(activePointerFile(dataDir))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func activePointerFile(dataDir string) string {
+	return filepath.Join(dataDir, "data", ".active")
+}
+
+// writeActivePointer records binDir as the active bin dir for when the bin
+// symlink cannot be created, giving it to owner if that is set.
+func writeActivePointer(dataDir, binDir string, owner *FileOwner) error {
+	dest := activePointerFile(dataDir)
+	tmp := dest + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(binDir+"\n"), 0644); err != nil {
+		return err
+	}
+	if owner != nil {
+		if err := lchown(tmp, owner); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// copyBinDir makes dest a directory with the same files as binDir, hardlinking
+// them where possible and removing any files binDir does not have.
+func copyBinDir(binDir, dest string) error {
+	if fi, err := os.Lstat(dest); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(dest); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(binDir)
+	if err != nil {
+		return err
+	}
+	want := map[string]bool{}
+	for _, f := range files {
+		want[f.Name()] = true
+		src, target := filepath.Join(binDir, f.Name()), filepath.Join(dest, f.Name())
+		if same, err := sameFile(src, target); err != nil {
+			return err
+		} else if same {
+			continue
+		}
+		if err := replaceWithLink(src, target); err != nil {
+			if err := copyFile(src, target+".tmp"); err != nil {
+				return err
+			}
+			if err := os.Rename(target+".tmp", target); err != nil {
+				return err
+			}
+		}
+	}
+
+	existing, err := ioutil.ReadDir(dest)
+	if err != nil {
+		return err
+	}
+	for _, f := range existing {
+		if !want[f.Name()] {
+			if err := os.RemoveAll(filepath.Join(dest, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// swapLink atomically replaces the symlink at link with one pointing at
+// target.
+func swapLink(link, target string) error {
+	tmp := link + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return errors.Wrapf(err, "failed to link %s to %s", link, target)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to link %s to %s", link, target)
+	}
+	return nil
+}
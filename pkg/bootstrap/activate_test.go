@@ -0,0 +1,253 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/rancher/rke2/pkg/images"
+)
+
+func TestActivateRuntimeRollback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	dataDir := tempDir(t)
+	v2 := images.Images{Runtime: "rancher/rke2-runtime:v1.18.5"}
+	first, err := StageWithResult(dataDir, testImages, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := StageWithResult(dataDir, v2, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := func() string {
+		t.Helper()
+		binDir, err := ResolveActiveBinDir(dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return binDir
+	}
+
+	_, firstName, err := EffectiveRuntimeReference(testImages, StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollback, err := ActivateRuntime(dataDir, firstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := active(); got != first.BinDir {
+		t.Errorf("active runtime is %s, want %s", got, first.BinDir)
+	}
+	if err := rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if got := active(); got != second.BinDir {
+		t.Errorf("rolled back to %s, want %s", got, second.BinDir)
+	}
+
+	// rolling back an activation with no previous runtime removes the link
+	if err := os.Remove(symlinkBinDir(dataDir)); err != nil {
+		t.Fatal(err)
+	}
+	rollback, err = ActivateRuntime(dataDir, firstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(symlinkBinDir(dataDir)); !os.IsNotExist(err) {
+		t.Errorf("bin link left after rollback: %v", err)
+	}
+
+	if _, err := ActivateRuntime(dataDir, "v1.18.6-missing"); err == nil {
+		t.Error("activated a runtime that is not staged")
+	}
+}
+
+func TestResolveActiveBinDirPointer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	dataDir := tempDir(t)
+	resolve := func() string {
+		t.Helper()
+		binDir, err := ResolveActiveBinDir(dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return binDir
+	}
+	if got := resolve(); got != "" {
+		t.Errorf("got active bin dir %q with nothing staged", got)
+	}
+
+	// the pointer file is used when there is no bin symlink
+	recorded := dataDirFor(dataDir, "v1.18.4-recorded")
+	if err := os.MkdirAll(recorded, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeActivePointer(dataDir, recorded, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolve(); got != recorded {
+		t.Errorf("got %s, want the recorded %s", got, recorded)
+	}
+
+	// linking the bin dir takes over from the pointer file
+	linked := dataDirFor(dataDir, "v1.18.5-linked")
+	if err := os.MkdirAll(linked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := linkBinDir(dataDir, linked, StageOptions{Logger: testLogger()}); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolve(); got != linked {
+		t.Errorf("got %s, want the linked %s", got, linked)
+	}
+	if _, err := os.Stat(activePointerFile(dataDir)); !os.IsNotExist(err) {
+		t.Errorf("pointer file left after linking: %v", err)
+	}
+}
+
+func TestStageCopyBinaries(t *testing.T) {
+	dataDir := tempDir(t)
+	opts := StageOptions{
+		Image:        testRuntimeImage(t, testEntry{name: "bin/crictl", body: "crictl", mode: 0755}),
+		CopyBinaries: true,
+		Logger:       testLogger(),
+	}
+	binDir, err := Stage(dataDir, testImages, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := symlinkBinDir(dataDir)
+	if fi, err := os.Lstat(link); err != nil || !fi.IsDir() {
+		t.Fatalf("%s is not a directory: %v", link, err)
+	}
+	for _, name := range listDir(t, binDir) {
+		a, err := os.Stat(filepath.Join(binDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(filepath.Join(link, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(a, b) {
+			t.Errorf("%s was copied rather than hardlinked", name)
+		}
+	}
+	if active, err := ResolveActiveBinDir(dataDir); err != nil || active != binDir {
+		t.Errorf("active bin dir is %q (%v), want %s", active, err, binDir)
+	}
+
+	// files the next runtime does not have are removed
+	opts.Image = testRuntimeImage(t)
+	binDir, err = Stage(dataDir, images.Images{Runtime: "rancher/rke2-runtime:v1.18.5"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listDir(t, link), listDir(t, binDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestActivateRuntimeCopiedBinDir(t *testing.T) {
+	dataDir := tempDir(t)
+	v2 := images.Images{Runtime: "rancher/rke2-runtime:v1.18.5"}
+	first, err := StageWithResult(dataDir, testImages, StageOptions{
+		Image:        testRuntimeImage(t, testEntry{name: "bin/crictl", body: "v1", mode: 0755}),
+		CopyBinaries: true,
+		Logger:       testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := StageWithResult(dataDir, v2, StageOptions{
+		Image:        testRuntimeImage(t, testEntry{name: "bin/crictl", body: "v2", mode: 0755}),
+		CopyBinaries: true,
+		Logger:       testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := symlinkBinDir(dataDir)
+	check := func(want string) {
+		t.Helper()
+		if fi, err := os.Lstat(link); err != nil || !fi.IsDir() {
+			t.Fatalf("%s is not a directory: %v", link, err)
+		}
+		if active, err := ResolveActiveBinDir(dataDir); err != nil || active != want {
+			t.Errorf("active bin dir is %q (%v), want %s", active, err, want)
+		}
+		if got, wantBody := readFile(t, filepath.Join(link, "crictl")), readFile(t, filepath.Join(want, "crictl")); got != wantBody {
+			t.Errorf("copied crictl is %q, want %q", got, wantBody)
+		}
+	}
+
+	_, firstName, err := EffectiveRuntimeReference(testImages, StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollback, err := ActivateRuntime(dataDir, firstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(first.BinDir)
+	if err := rollback(); err != nil {
+		t.Fatal(err)
+	}
+	check(second.BinDir)
+}
+
+func TestActivateRuntimePointer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	dataDir := tempDir(t)
+	v2 := images.Images{Runtime: "rancher/rke2-runtime:v1.18.5"}
+	first, err := StageWithResult(dataDir, testImages, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := StageWithResult(dataDir, v2, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as left when the bin symlink could not be created
+	if err := os.Remove(symlinkBinDir(dataDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeActivePointer(dataDir, second.BinDir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, firstName, err := EffectiveRuntimeReference(testImages, StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollback, err := ActivateRuntime(dataDir, firstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(symlinkBinDir(dataDir)); err != nil || target != first.BinDir {
+		t.Errorf("bin links to %q (%v), want %q", target, err, first.BinDir)
+	}
+	if _, err := os.Stat(activePointerFile(dataDir)); !os.IsNotExist(err) {
+		t.Errorf("stale pointer file left after activation: %v", err)
+	}
+	if err := rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := ResolveActiveBinDir(dataDir); err != nil || active != second.BinDir {
+		t.Errorf("rolled back to %q (%v), want %s", active, err, second.BinDir)
+	}
+}
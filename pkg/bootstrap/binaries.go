@@ -0,0 +1,26 @@
+// +build !windows
+
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+)
+
+var (
+	// requiredBinaries are the runtime binaries that must be present and
+	// executable before a freshly staged bin dir is put into use.
+	requiredBinaries = []string{"containerd", "kubelet", "runc"}
+
+	// binaryMagic is the signature executables start with.
+	binaryMagic = []byte("\x7fELF")
+)
+
+// checkExecutable checks that the file described by fi can be executed by
+// someone.
+func checkExecutable(fi os.FileInfo) error {
+	if fi.Mode()&0111 == 0 {
+		return fmt.Errorf("file mode %s is not executable", fi.Mode())
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package bootstrap
+
+import "os"
+
+var (
+	// requiredBinaries are the runtime binaries that must be present and
+	// executable before a freshly staged bin dir is put into use. The
+	// Windows runtime does not ship runc.
+	requiredBinaries = []string{"containerd.exe", "kubelet.exe"}
+
+	// binaryMagic is the signature executables start with.
+	binaryMagic = []byte("MZ")
+)
+
+// checkExecutable does nothing, as whether a file can be executed depends on
+// its extension rather than its mode on Windows.
+func checkExecutable(fi os.FileInfo) error {
+	return nil
+}
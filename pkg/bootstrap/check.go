@@ -0,0 +1,56 @@
+package bootstrap
+
+import (
+	"fmt"
+
+	"github.com/rancher/rke2/pkg/images"
+)
+
+// CheckResult is the outcome of a single check run by CheckRuntime. Err is
+// nil if the check passed.
+type CheckResult struct {
+	Name string
+	Err  error
+}
+
+// CheckRuntime verifies that a runtime has been staged into dataDir: the
+// active bin dir exists and is the one for images, the required binaries in
+// it are valid, and the manifests dir exists. All checks are run, even if
+// earlier ones fail.
+func CheckRuntime(dataDir string, images images.Images, opts StageOptions) []CheckResult {
+	var results []CheckResult
+
+	binDir, err := ResolveActiveBinDir(dataDir)
+	if err == nil && binDir == "" {
+		err = fmt.Errorf("%s is not a symlink to a runtime bin dir", symlinkBinDir(dataDir))
+	} else if err == nil && !dirExists(binDir) {
+		err = fmt.Errorf("active runtime bin dir %s is missing", binDir)
+	}
+	results = append(results, CheckResult{Name: "active bin dir", Err: err})
+
+	staged, err := IsStaged(dataDir, images, opts)
+	if err == nil && !staged {
+		_, dataName, _ := EffectiveRuntimeReference(images, opts)
+		if dataName == "" {
+			opts.logger().Infof("Runtime image %s is not a release, skipping staged version check", images.Runtime)
+		} else {
+			err = fmt.Errorf("%s is not staged in %s", images.Runtime, dataDir)
+		}
+	}
+	results = append(results, CheckResult{Name: "staged version", Err: err})
+
+	if binDir == "" || !dirExists(binDir) {
+		err = fmt.Errorf("no bin dir to validate")
+	} else {
+		err = validateBinaries(binDir)
+	}
+	results = append(results, CheckResult{Name: "runtime binaries", Err: err})
+
+	err = nil
+	if !dirExists(opts.manifestsDir(dataDir)) {
+		err = fmt.Errorf("%s does not exist", opts.manifestsDir(dataDir))
+	}
+	results = append(results, CheckResult{Name: "manifests", Err: err})
+
+	return results
+}
@@ -0,0 +1,45 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func failedChecks(results []CheckResult) []string {
+	var failed []string
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result.Name)
+		}
+	}
+	return failed
+}
+
+func TestCheckRuntime(t *testing.T) {
+	dataDir := tempDir(t)
+	opts := StageOptions{Logger: testLogger()}
+	if failed := failedChecks(CheckRuntime(dataDir, testImages, opts)); len(failed) != 4 {
+		t.Errorf("empty data dir failed %v, want every check to fail", failed)
+	}
+
+	opts.Image = testRuntimeImage(t)
+	binDir, err := Stage(dataDir, testImages, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := failedChecks(CheckRuntime(dataDir, testImages, opts)); len(failed) != 0 {
+		t.Errorf("staged runtime failed %v", failed)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if err := os.Chmod(filepath.Join(binDir, requiredBinaries[0]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if failed := failedChecks(CheckRuntime(dataDir, testImages, opts)); len(failed) != 1 || failed[0] != "runtime binaries" {
+		t.Errorf("non-executable binary failed %v, want only the runtime binaries check", failed)
+	}
+}
@@ -0,0 +1,15 @@
+// +build !windows
+
+package bootstrap
+
+import "os"
+
+// chown sets the owner of the extracted file f.
+func chown(f *os.File, owner *FileOwner) error {
+	return f.Chown(owner.UID, owner.GID)
+}
+
+// lchown sets the owner of the staged path name, not following symlinks.
+func lchown(name string, owner *FileOwner) error {
+	return os.Lchown(name, owner.UID, owner.GID)
+}
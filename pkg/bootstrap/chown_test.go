@@ -0,0 +1,72 @@
+// +build !windows
+
+package bootstrap
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestStageOwner(t *testing.T) {
+	// only root can give files away
+	owner := &FileOwner{UID: os.Getuid(), GID: os.Getgid()}
+	if owner.UID == 0 {
+		owner = &FileOwner{UID: 1, GID: 1}
+	}
+
+	for _, copyBinaries := range []bool{false, true} {
+		dataDir := tempDir(t)
+		extraDir := filepath.Join(tempDir(t), "share")
+		result, err := StageWithResult(dataDir, testImages, StageOptions{
+			Image: testRuntimeImage(t,
+				testEntry{name: "bin/crictl-link", typeflag: tar.TypeSymlink, linkname: "crictl"},
+				testEntry{name: "bin/crictl", body: "crictl", mode: 0755},
+				testEntry{name: "charts/rke2-canal-copy.yaml", typeflag: tar.TypeLink, linkname: "charts/rke2-canal.yaml"},
+				testEntry{name: "share/README", body: "readme"},
+			),
+			ExtraExtractPaths: map[string]string{"share": extraDir},
+			CopyBinaries:      copyBinaries,
+			Owner:             owner,
+			Logger:            testLogger(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		manifests := manifestsDir(dataDir)
+		files := []string{
+			filepath.Dir(result.BinDir),
+			stageInfoFile(dataDir, filepath.Base(filepath.Dir(result.BinDir))),
+			manifests,
+			filepath.Join(manifests, "rke2-canal.yaml"),
+			filepath.Join(manifests, "rke2-canal-copy.yaml"),
+			extraDir,
+			filepath.Join(extraDir, "README"),
+			result.BinDir,
+			symlinkBinDir(dataDir),
+		}
+		binDirs := []string{result.BinDir}
+		if copyBinaries {
+			binDirs = append(binDirs, symlinkBinDir(dataDir))
+			files = append(files, activePointerFile(dataDir))
+		}
+		for _, dir := range binDirs {
+			for _, name := range listDir(t, dir) {
+				files = append(files, filepath.Join(dir, name))
+			}
+		}
+		for _, file := range files {
+			fi, err := os.Lstat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			if int(st.Uid) != owner.UID || int(st.Gid) != owner.GID {
+				t.Errorf("%s is owned by %d:%d, want %d:%d", file, st.Uid, st.Gid, owner.UID, owner.GID)
+			}
+		}
+	}
+}
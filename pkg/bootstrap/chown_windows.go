@@ -0,0 +1,13 @@
+package bootstrap
+
+import "os"
+
+func chown(_ *os.File, _ *FileOwner) error {
+	// not supported in this OS
+	return nil
+}
+
+func lchown(_ string, _ *FileOwner) error {
+	// not supported in this OS
+	return nil
+}
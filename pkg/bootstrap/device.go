@@ -0,0 +1,27 @@
+// +build !windows
+
+package bootstrap
+
+import (
+	"os"
+	"syscall"
+)
+
+// sameDevice reports whether the existing paths a and b are on the same
+// filesystem, so that files can be renamed between them.
+func sameDevice(a, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	aStat, aOK := aInfo.Sys().(*syscall.Stat_t)
+	bStat, bOK := bInfo.Sys().(*syscall.Stat_t)
+	if !aOK || !bOK {
+		return false, nil
+	}
+	return aStat.Dev == bStat.Dev, nil
+}
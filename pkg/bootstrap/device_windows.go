@@ -0,0 +1,19 @@
+package bootstrap
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+func sameDevice(a, b string) (bool, error) {
+	// compare volumes, device ids are not available in this OS
+	a, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	b, err = filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(filepath.VolumeName(a), filepath.VolumeName(b)), nil
+}
@@ -0,0 +1,46 @@
+package bootstrap
+
+import "fmt"
+
+// PullError is returned by Stage when the runtime image cannot be pulled
+// from its registry or any of the configured mirrors.
+type PullError struct {
+	Image string
+	Err   error
+}
+
+func (e *PullError) Error() string {
+	return fmt.Sprintf("failed to pull runtime image %s: %v", e.Image, e.Err)
+}
+
+func (e *PullError) Unwrap() error { return e.Err }
+func (e *PullError) Cause() error  { return e.Err }
+
+// ExtractError is returned by Stage when the runtime image cannot be
+// extracted into the data dir.
+type ExtractError struct {
+	Image   string
+	DataDir string
+	Err     error
+}
+
+func (e *ExtractError) Error() string {
+	return fmt.Sprintf("failed to extract runtime image %s to %s: %v", e.Image, e.DataDir, e.Err)
+}
+
+func (e *ExtractError) Unwrap() error { return e.Err }
+func (e *ExtractError) Cause() error  { return e.Err }
+
+// ValidationError is returned by Stage when the extracted runtime binaries
+// fail validation. The bad bin dir has already been removed.
+type ValidationError struct {
+	BinDir string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("runtime binaries in %s are invalid: %v", e.BinDir, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+func (e *ValidationError) Cause() error  { return e.Err }
@@ -0,0 +1,39 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/rancher/rke2/pkg/images"
+)
+
+func TestStageErrors(t *testing.T) {
+	// nothing listens on the registry
+	_, err := Stage(tempDir(t), images.Images{Runtime: "127.0.0.1:1/rancher/rke2-runtime:v1.18.4"}, StageOptions{Logger: testLogger()})
+	if pullErr, ok := err.(*PullError); !ok {
+		t.Errorf("got error %v, want a PullError", err)
+	} else if pullErr.Image != "127.0.0.1:1/rancher/rke2-runtime:v1.18.4" || pullErr.Unwrap() == nil {
+		t.Errorf("got %+v", pullErr)
+	}
+
+	dataDir := tempDir(t)
+	_, err = Stage(dataDir, testImages, StageOptions{
+		Image:  testImage(t, testLayer(t, testEntry{name: "bin/kubelet", body: "kubelet"})),
+		Logger: testLogger(),
+	})
+	if extractErr, ok := err.(*ExtractError); !ok {
+		t.Errorf("got error %v, want an ExtractError", err)
+	} else if extractErr.DataDir != dataDir || extractErr.Unwrap() == nil {
+		t.Errorf("got %+v", extractErr)
+	}
+
+	_, err = Stage(tempDir(t), testImages, StageOptions{
+		Image:            testRuntimeImage(t, testEntry{name: "bin/" + requiredBinaries[0], body: "not a binary", mode: 0755}),
+		ValidateBinaries: true,
+		Logger:           testLogger(),
+	})
+	if validationErr, ok := err.(*ValidationError); !ok {
+		t.Errorf("got error %v, want a ValidationError", err)
+	} else if validationErr.Unwrap() == nil {
+		t.Errorf("got %+v", validationErr)
+	}
+}
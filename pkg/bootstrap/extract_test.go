@@ -0,0 +1,224 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestEntryPath(t *testing.T) {
+	for name, want := range map[string]string{
+		"bin/containerd":         "/bin/containerd",
+		"./bin/containerd":       "/bin/containerd",
+		"/charts/":               "/charts",
+		`bin\containerd.exe`:     "/bin/containerd.exe",
+		`.\bin\..\charts\a.yaml`: "/charts/a.yaml",
+		"../../etc/passwd":       "/etc/passwd",
+	} {
+		if got := entryPath(name); got != want {
+			t.Errorf("entryPath(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExtractWindowsPaths(t *testing.T) {
+	data := testTar(t,
+		testEntry{name: `bin\containerd.exe`, body: "MZ"},
+		testEntry{name: `.\charts\rke2-canal.yaml`, body: "canal"},
+	)
+	dir := tempDir(t)
+	if _, err := extract("test", dir, bytes.NewReader(data), testExtractOptions("bin", "charts")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "bin", "containerd.exe")); got != "MZ" {
+		t.Errorf("got %q, want MZ", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "charts", "rke2-canal.yaml")); got != "canal" {
+		t.Errorf("got %q, want canal", got)
+	}
+}
+
+func TestExtractImageDirs(t *testing.T) {
+	targetDir := tempDir(t)
+	absDir := filepath.Join(tempDir(t), "manifests")
+	if err := ExtractImageDirs(testRuntimeImage(t), targetDir, map[string]string{
+		"bin":    "bin",
+		"charts": absDir,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateBinaries(filepath.Join(targetDir, "bin")); err != nil {
+		t.Error(err)
+	}
+	if got := readFile(t, filepath.Join(absDir, "rke2-canal.yaml")); got != "canal" {
+		t.Errorf("got %q, want canal", got)
+	}
+
+	if err := ExtractImageDirs(testRuntimeImage(t), tempDir(t), map[string]string{"share": "share"}); err == nil {
+		t.Error("extracted a directory the image does not have")
+	}
+}
+
+func TestExtractTolerateFileErrors(t *testing.T) {
+	data := testTar(t,
+		testEntry{name: "bin/containerd", body: "containerd"},
+		testEntry{name: "bin/kubelet", body: "kubelet"},
+		testEntry{name: "bin/runc", body: "runc"},
+	)
+	for _, tolerate := range []bool{false, true} {
+		dir := tempDir(t)
+		// a directory in the way makes creating the file fail
+		if err := os.MkdirAll(filepath.Join(dir, "bin", "kubelet"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		opts := testExtractOptions("bin")
+		opts.tolerateFileErrors = tolerate
+		stats, err := extract("test", dir, bytes.NewReader(data), opts)
+		if err == nil {
+			t.Fatalf("tolerate %v: file error was not reported", tolerate)
+		}
+		_, runcErr := os.Stat(filepath.Join(dir, "bin", "runc"))
+		if tolerate && (stats.Files != 2 || runcErr != nil) {
+			t.Errorf("tolerated errors stopped extraction: %d files, %v", stats.Files, runcErr)
+		} else if !tolerate && (stats.Files != 1 || !os.IsNotExist(runcErr)) {
+			t.Errorf("extraction went on past an error: %d files, %v", stats.Files, runcErr)
+		}
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	data := testTar(t,
+		testEntry{name: "bin/sub/runc", body: "runc"},
+		testEntry{name: "bin/runc-link", typeflag: tar.TypeLink, linkname: "bin/sub/runc"},
+		testEntry{name: "bin/sub/ctr", typeflag: tar.TypeSymlink, linkname: "../containerd"},
+		testEntry{name: "bin/abs", typeflag: tar.TypeSymlink, linkname: "/bin/containerd"},
+		testEntry{name: "bin/host", typeflag: tar.TypeSymlink, linkname: "/usr/bin/containerd"},
+		testEntry{name: "bin/fifo", typeflag: tar.TypeFifo},
+		testEntry{name: "bin/containerd", body: "containerd"},
+		// replacing a file must not change the hardlink made to it
+		testEntry{name: "bin/runc", body: "new"},
+	)
+	dir := tempDir(t)
+	stats, err := extract("test", dir, bytes.NewReader(data), testExtractOptions("bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 4 || stats.Symlinks != 3 {
+		t.Errorf("got %d files and %d symlinks, want 4 and 3", stats.Files, stats.Symlinks)
+	}
+
+	bin := filepath.Join(dir, "bin")
+	for name, want := range map[string]string{"ctr": "containerd", "abs": "containerd", "host": "/usr/bin/containerd"} {
+		if got, err := os.Readlink(filepath.Join(bin, name)); err != nil || got != want {
+			t.Errorf("%s links to %q (%v), want %q", name, got, err, want)
+		}
+	}
+	if got := readFile(t, filepath.Join(bin, "ctr")); got != "containerd" {
+		t.Errorf("ctr reads %q, want containerd", got)
+	}
+	if got := readFile(t, filepath.Join(bin, "runc-link")); got != "runc" {
+		t.Errorf("runc-link reads %q, want runc", got)
+	}
+	if got := readFile(t, filepath.Join(bin, "runc")); got != "new" {
+		t.Errorf("runc reads %q, want new", got)
+	}
+	if _, err := os.Lstat(filepath.Join(bin, "fifo")); !os.IsNotExist(err) {
+		t.Errorf("fifo was extracted: %v", err)
+	}
+
+	data = testTar(t, testEntry{name: "bin/runc", typeflag: tar.TypeLink, linkname: "usr/bin/runc"})
+	if _, err := extract("test", tempDir(t), bytes.NewReader(data), testExtractOptions("bin")); err == nil {
+		t.Error("extracted a hardlink to a file outside the extracted directories")
+	}
+}
+
+func TestExtractMaxFileSize(t *testing.T) {
+	data := testTar(t,
+		testEntry{name: "bin/containerd", body: "small"},
+		testEntry{name: "bin/kubelet", body: "far too large"},
+	)
+	dir := tempDir(t)
+	opts := testExtractOptions("bin")
+	opts.maxFileSize = 8
+	if _, err := extract("test", dir, bytes.NewReader(data), opts); err == nil {
+		t.Fatal("extracted a file larger than the maximum")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bin", "kubelet")); !os.IsNotExist(err) {
+		t.Errorf("oversized file was written: %v", err)
+	}
+
+	dataDir := tempDir(t)
+	_, err := Stage(dataDir, testImages, StageOptions{
+		Image:       testRuntimeImage(t, testEntry{name: "bin/large", body: strings.Repeat("x", 64)}),
+		MaxFileSize: 32,
+		Logger:      testLogger(),
+	})
+	if _, ok := err.(*ExtractError); !ok {
+		t.Errorf("got error %v, want an ExtractError", err)
+	}
+	if staged, _ := StagedRuntimes(dataDir); len(staged) != 0 {
+		t.Errorf("runtime with an oversized file was staged: %v", staged)
+	}
+}
+
+func TestStageHeaderHook(t *testing.T) {
+	dataDir := tempDir(t)
+	img := testRuntimeImage(t,
+		testEntry{name: "charts/rke2-coredns.yaml", body: "coredns"},
+		testEntry{name: "charts/rke2-ingress.yaml", body: "ingress"},
+	)
+	hook := func(h *tar.Header) (*tar.Header, bool, error) {
+		switch h.Name {
+		case "charts/rke2-coredns.yaml":
+			h.Name = "charts/rke2-dns.yaml"
+		case "charts/rke2-ingress.yaml":
+			return h, false, nil
+		}
+		return h, true, nil
+	}
+	if _, err := Stage(dataDir, testImages, StageOptions{Image: img, HeaderHook: hook, Logger: testLogger()}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listDir(t, manifestsDir(dataDir)), []string{"rke2-canal.yaml", "rke2-dns.yaml"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got charts %v, want %v", got, want)
+	}
+
+	failing := func(h *tar.Header) (*tar.Header, bool, error) {
+		return nil, false, errors.New("rejected")
+	}
+	_, err := Stage(tempDir(t), testImages, StageOptions{Image: img, HeaderHook: failing, Logger: testLogger()})
+	if _, ok := err.(*ExtractError); !ok {
+		t.Errorf("got error %v, want an ExtractError", err)
+	}
+}
+
+func TestExtractRemovesPartialFile(t *testing.T) {
+	body := strings.Repeat("k", 4096)
+	data := testTar(t,
+		testEntry{name: "bin/containerd", body: "containerd"},
+		testEntry{name: "bin/kubelet", body: body},
+	)
+	// cut the archive off halfway through the kubelet body
+	data = data[:bytes.Index(data, []byte(body))+len(body)/2]
+
+	dir := tempDir(t)
+	if _, err := extract("test", dir, bytes.NewReader(data), testExtractOptions("bin")); err == nil {
+		t.Fatal("extracted a truncated archive")
+	}
+	if got := readFile(t, filepath.Join(dir, "bin", "containerd")); got != "containerd" {
+		t.Errorf("got %q, want containerd", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bin", "kubelet")); !os.IsNotExist(err) {
+		t.Errorf("partially written file was left behind: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// imageListDir is the directory of the runtime image holding text files
+// that list the images the runtime uses, one per line.
+const imageListDir = "/images/"
+
+// WriteImagesList writes the sorted, de-duplicated list of images named in
+// the image lists embedded in img to out, one per line. Blank lines and
+// lines starting with # are ignored. It is an error for img to have no image
+// lists, as it is then not a runtime image.
+func WriteImagesList(img v1.Image, out io.Writer) error {
+	r := mutate.Extract(img)
+	defer r.Close()
+
+	found := false
+	seen := map[string]bool{}
+	t := tar.NewReader(r)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		n := entryPath(h.Name)
+		if !h.FileInfo().Mode().IsRegular() || !strings.HasPrefix(n, imageListDir) || path.Ext(n) != ".txt" {
+			continue
+		}
+
+		found = true
+		scanner := bufio.NewScanner(t)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			seen[line] = true
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("no image lists found under %s", imageListDir)
+	}
+
+	list := make([]string, 0, len(seen))
+	for image := range seen {
+		list = append(list, image)
+	}
+	sort.Strings(list)
+
+	for _, image := range list {
+		if _, err := fmt.Fprintln(out, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListImageContents writes the mode, size and name of each entry in the
+// flattened filesystem of img to w, similar to tar -tv.
+func ListImageContents(img v1.Image, w io.Writer) error {
+	r := mutate.Extract(img)
+	defer r.Close()
+
+	t := tar.NewReader(r)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := h.Name
+		if h.Linkname != "" {
+			name += " -> " + h.Linkname
+		}
+		if _, err := fmt.Fprintf(w, "%s %12d %s\n", h.FileInfo().Mode(), h.Size, name); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteImagesList(t *testing.T) {
+	img := testImage(t,
+		testLayer(t, testEntry{name: "images/core.txt", body: "rancher/pause:3.2\n# comment\n\nrancher/etcd:v3.4.3\n"}),
+		testLayer(t,
+			testEntry{name: "images/extra.txt", body: "rancher/pause:3.2\nrancher/coredns:1.6.9\n"},
+			testEntry{name: "images/README", body: "not a list"},
+		),
+	)
+	out := &bytes.Buffer{}
+	if err := WriteImagesList(img, out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "rancher/coredns:1.6.9\nrancher/etcd:v3.4.3\nrancher/pause:3.2\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+
+	if err := WriteImagesList(testRuntimeImage(t), &bytes.Buffer{}); err == nil {
+		t.Error("wrote an images list for an image without any")
+	}
+}
+
+func TestListImageContents(t *testing.T) {
+	img := testImage(t, testLayer(t,
+		testEntry{name: "bin/containerd", body: "containerd", mode: 0755},
+		testEntry{name: "bin/ctr", typeflag: tar.TypeSymlink, linkname: "containerd"},
+	))
+	out := &bytes.Buffer{}
+	if err := ListImageContents(img, out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), out)
+	}
+	if fields := strings.Fields(lines[0]); len(fields) != 3 || fields[0] != "-rwxr-xr-x" || fields[1] != "10" || fields[2] != "bin/containerd" {
+		t.Errorf("got %q for a file", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "L") || !strings.HasSuffix(lines[1], "bin/ctr -> containerd") {
+		t.Errorf("got %q for a symlink", lines[1])
+	}
+}
@@ -0,0 +1,121 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StageInfo records what was staged into a runtime data dir, and when.
+type StageInfo struct {
+	Image    string    `json:"image"`
+	Digest   string    `json:"digest"`
+	StagedAt time.Time `json:"stagedAt"`
+	Files    int       `json:"files"`
+	Bytes    int64     `json:"bytes"`
+}
+
+func stageInfoFile(dataDir, dataName string) string {
+	return filepath.Join(dataDir, "data", dataName, ".staged.json")
+}
+
+// ReadStageInfo returns the information recorded when the runtime data dir
+// named dataName was staged.
+func ReadStageInfo(dataDir, dataName string) (*StageInfo, error) {
+	data, err := ioutil.ReadFile(stageInfoFile(dataDir, dataName))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &StageInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// StagedRuntime describes a runtime data dir found in a data dir.
+type StagedRuntime struct {
+	Name    string
+	BinDir  string
+	ModTime time.Time
+	// Info is nil if the runtime was staged before stage info was recorded.
+	Info *StageInfo
+	// Active is true if BinDir is the active runtime bin dir.
+	Active bool
+}
+
+// StagedRuntimes lists the runtimes staged in dataDir whose bin dirs still
+// exist.
+func StagedRuntimes(dataDir string) ([]StagedRuntime, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(dataDir, "data"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	active, _ := ResolveActiveBinDir(dataDir)
+
+	var runtimes []StagedRuntime
+	for _, dir := range dirs {
+		binDir := dataDirFor(dataDir, dir.Name())
+		if !dir.IsDir() || !dirExists(binDir) {
+			continue
+		}
+		runtime := StagedRuntime{
+			Name:    dir.Name(),
+			BinDir:  binDir,
+			ModTime: dir.ModTime(),
+			Active:  binDir == active,
+		}
+		if info, err := ReadStageInfo(dataDir, dir.Name()); err == nil {
+			runtime.Info = info
+		}
+		runtimes = append(runtimes, runtime)
+	}
+	return runtimes, nil
+}
+
+// latestStaged returns the name of the most recently staged runtime data
+// dir in dataDir, or an empty string if there is none.
+func latestStaged(dataDir string) (string, error) {
+	runtimes, err := StagedRuntimes(dataDir)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		latest   string
+		stagedAt time.Time
+	)
+	for _, runtime := range runtimes {
+		if runtime.Info == nil {
+			continue
+		}
+		if latest == "" || runtime.Info.StagedAt.After(stagedAt) {
+			latest, stagedAt = runtime.Name, runtime.Info.StagedAt
+		}
+	}
+	return latest, nil
+}
+
+func writeStageInfo(dataDir, dataName string, info StageInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	dest := stageInfoFile(dataDir, dataName)
+	tmp := dest + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
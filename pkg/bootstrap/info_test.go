@@ -0,0 +1,69 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rancher/rke2/pkg/images"
+)
+
+func TestStageWritesStageInfo(t *testing.T) {
+	dataDir := tempDir(t)
+	img := testRuntimeImage(t)
+	binDir, err := Stage(dataDir, testImages, StageOptions{Image: img, Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ReadStageInfo(dataDir, filepath.Base(filepath.Dir(binDir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Image != testRuntime || info.Digest != digest.String() {
+		t.Errorf("got %s@%s, want %s@%s", info.Image, info.Digest, testRuntime, digest)
+	}
+	if want := len(requiredBinaries) + 1; info.Files != want || info.Bytes == 0 || info.StagedAt.IsZero() {
+		t.Errorf("got %+v, want %d files", info, want)
+	}
+}
+
+func TestStagedRuntimes(t *testing.T) {
+	dataDir := tempDir(t)
+	if runtimes, err := StagedRuntimes(dataDir); err != nil || len(runtimes) != 0 {
+		t.Fatalf("got %v, %v for an empty data dir", runtimes, err)
+	}
+
+	first, err := Stage(dataDir, testImages, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Stage(dataDir, images.Images{Runtime: "rancher/rke2-runtime:v1.18.5"}, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a data dir without a bin dir is not a staged runtime
+	if err := os.MkdirAll(filepath.Join(dataDir, "data", "v1.18.6-partial"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	runtimes, err := StagedRuntimes(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, runtime := range runtimes {
+		got[runtime.BinDir] = runtime.Active
+		if runtime.Info == nil {
+			t.Errorf("%s has no stage info", runtime.Name)
+		}
+	}
+	if want := map[string]bool{first: false, second: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got runtimes %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,165 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/rancher/wrangler/pkg/merr"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+	// maxParallelLayers bounds how many layers are read at once.
+	maxParallelLayers = 4
+)
+
+// extractImage extracts the top-level directories in opts.dirs from img into
+// the directories of the same name in targetDir, reading the image once.
+// Layers are extracted concurrently when the image exposes its layer
+// structure; otherwise the flattened filesystem is extracted serially.
+func extractImage(imgName, targetDir string, img v1.Image, opts extractOptions) (extractStats, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		opts.log.Debugf("Layers of %s unavailable, extracting flattened image: %v", imgName, err)
+		r := mutate.Extract(img)
+		defer r.Close()
+		return extract(imgName, targetDir, r, opts)
+	}
+	return extractLayers(imgName, targetDir, layers, opts)
+}
+
+// extractLayers extracts each layer into its own scratch directory, up to
+// maxParallelLayers at a time, then merges the results into targetDir in layer order so that
+// files and whiteouts in later layers take precedence over earlier ones.
+func extractLayers(imgName, targetDir string, layers []v1.Layer, opts extractOptions) (extractStats, error) {
+	stats := newExtractStats()
+	for src := range opts.dirs {
+		if err := os.MkdirAll(filepath.Join(targetDir, src), 0755); err != nil {
+			return stats, err
+		}
+	}
+
+	layerDirs := make([]string, len(layers))
+	defer func() {
+		for _, dir := range layerDirs {
+			if dir != "" {
+				os.RemoveAll(dir)
+			}
+		}
+	}()
+
+	var totalSize int64
+	for _, layer := range layers {
+		if size, err := layer.Size(); err == nil {
+			totalSize += size
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		done     int
+		doneSize int64
+	)
+	errs := make([]error, len(layers))
+	layerStats := make([]extractStats, len(layers))
+	sem := make(chan struct{}, maxParallelLayers)
+	for i, layer := range layers {
+		wg.Add(1)
+		go func(i int, layer v1.Layer) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			layerDirs[i], errs[i] = ioutil.TempDir(filepath.Dir(targetDir), ".layer-*")
+			if errs[i] != nil {
+				return
+			}
+			r, err := layer.Uncompressed()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer r.Close()
+			layerStats[i], errs[i] = extract(imgName, layerDirs[i], r, opts)
+
+			size, _ := layer.Size()
+			lock.Lock()
+			defer lock.Unlock()
+			done++
+			doneSize += size
+			opts.progress("Read %s layer %d/%d, %d/%d bytes", imgName, done, len(layers), doneSize, totalSize)
+		}(i, layer)
+	}
+	wg.Wait()
+
+	for _, s := range layerStats {
+		stats.add(s)
+	}
+	if err := merr.NewErrors(errs...); err != nil {
+		return stats, err
+	}
+
+	paths := map[string]string{}
+	for i, dir := range layerDirs {
+		if err := mergeLayer(dir, targetDir, layerStats[i], paths); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// mergeLayer moves the files extracted from a single layer into targetDir.
+// paths maps the files already in targetDir to the entries they were
+// extracted from, and is updated with the files of the layer. The layer's
+// whiteouts are applied first so that they only hide files that came from
+// earlier layers, and files of earlier layers that the layer has unchanged
+// from the destination are removed so that they do not replace it.
+func mergeLayer(layerDir, targetDir string, layer extractStats, paths map[string]string) error {
+	for file, entry := range paths {
+		for _, whiteout := range layer.whiteouts {
+			if !hides(whiteout, entry) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(targetDir, file)); err != nil {
+				return err
+			}
+			delete(paths, file)
+			break
+		}
+	}
+
+	for file := range layer.unchanged {
+		if err := os.RemoveAll(filepath.Join(targetDir, file)); err != nil {
+			return err
+		}
+		delete(paths, file)
+	}
+
+	for file, entry := range layer.paths {
+		if err := os.Rename(filepath.Join(layerDir, file), filepath.Join(targetDir, file)); err != nil {
+			return err
+		}
+		paths[file] = entry
+	}
+	return nil
+}
+
+// hides reports whether the whiteout marker at path whiteout hides the entry
+// at path entry. An opaque marker hides everything below the directory it is
+// in; any other marker hides the entry it names and everything below it.
+func hides(whiteout, entry string) bool {
+	dir, base := path.Split(whiteout)
+	if base == whiteoutOpaque {
+		return strings.HasPrefix(entry, dir)
+	}
+	hidden := dir + strings.TrimPrefix(base, whiteoutPrefix)
+	return entry == hidden || strings.HasPrefix(entry, hidden+"/")
+}
@@ -0,0 +1,245 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+func TestExtractLayersWhiteouts(t *testing.T) {
+	layers := []v1.Layer{
+		testLayer(t,
+			testEntry{name: "charts/a.yaml", body: "a"},
+			testEntry{name: "charts/c.yaml", body: "c"},
+			testEntry{name: "charts/sub/b.yaml", body: "b"},
+			testEntry{name: "charts/other/e.yaml", body: "e"},
+		),
+		testLayer(t,
+			// an opaque marker only hides the earlier contents of its own
+			// directory, not files added alongside it in the same layer
+			testEntry{name: "charts/sub/d.yaml", body: "d"},
+			testEntry{name: "charts/sub/.wh..wh..opq"},
+			testEntry{name: "charts/.wh.a.yaml"},
+			testEntry{name: "charts/.wh.other"},
+			testEntry{name: "charts/f.yaml", body: "f"},
+			testEntry{name: "charts/.wh.f.yaml"},
+		),
+	}
+
+	dir := tempDir(t)
+	if _, err := extractLayers("test", dir, layers, testExtractOptions("charts")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listDir(t, filepath.Join(dir, "charts")), []string{"c.yaml", "d.yaml", "f.yaml"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExtractLayersTopLevelWhiteouts(t *testing.T) {
+	layers := []v1.Layer{
+		testLayer(t,
+			testEntry{name: "bin/a", body: "a"},
+			testEntry{name: "bin/b", body: "b"},
+			testEntry{name: "charts/c.yaml", body: "c"},
+		),
+		testLayer(t,
+			testEntry{name: ".wh.bin"},
+			testEntry{name: "bin/new", body: "new"},
+			testEntry{name: "charts/.wh..wh..opq"},
+			testEntry{name: "charts/d.yaml", body: "d"},
+		),
+	}
+
+	dir := tempDir(t)
+	if _, err := extractLayers("test", dir, layers, testExtractOptions("bin", "charts")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listDir(t, filepath.Join(dir, "bin")), []string{"new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got bin %v, want %v", got, want)
+	}
+	if got, want := listDir(t, filepath.Join(dir, "charts")), []string{"d.yaml"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got charts %v, want %v", got, want)
+	}
+
+	// an opaque marker at the root hides every earlier directory
+	layers = append(layers, testLayer(t, testEntry{name: ".wh..wh..opq"}))
+	dir = tempDir(t)
+	if _, err := extractLayers("test", dir, layers, testExtractOptions("bin", "charts")); err != nil {
+		t.Fatal(err)
+	}
+	if got := append(listDir(t, filepath.Join(dir, "bin")), listDir(t, filepath.Join(dir, "charts"))...); len(got) != 0 {
+		t.Errorf("got %v, want nothing", got)
+	}
+}
+
+func TestExtractLayersBoundsConcurrency(t *testing.T) {
+	var open, most int32
+	var layers []v1.Layer
+	for i := 0; i < 3*maxParallelLayers; i++ {
+		layers = append(layers, concurrentLayer{testLayer(t, testEntry{name: fmt.Sprintf("bin/%d", i), body: "x"}), &open, &most})
+	}
+	if _, err := extractLayers("test", tempDir(t), layers, testExtractOptions("bin")); err != nil {
+		t.Fatal(err)
+	}
+	if most > maxParallelLayers {
+		t.Errorf("read %d layers at once, want at most %d", most, maxParallelLayers)
+	}
+}
+
+// concurrentLayer tracks how many layers are being read at once.
+type concurrentLayer struct {
+	v1.Layer
+	open, most *int32
+}
+
+func (l concurrentLayer) Uncompressed() (io.ReadCloser, error) {
+	n := atomic.AddInt32(l.open, 1)
+	for {
+		most := atomic.LoadInt32(l.most)
+		if n <= most || atomic.CompareAndSwapInt32(l.most, most, n) {
+			break
+		}
+	}
+	// keep the stream open for a while so that reads overlap
+	time.Sleep(10 * time.Millisecond)
+	r, err := l.Layer.Uncompressed()
+	if err != nil {
+		atomic.AddInt32(l.open, -1)
+		return nil, err
+	}
+	return closeFunc{r, func() { atomic.AddInt32(l.open, -1) }}, nil
+}
+
+type closeFunc struct {
+	io.ReadCloser
+	done func()
+}
+
+func (c closeFunc) Close() error {
+	c.done()
+	return c.ReadCloser.Close()
+}
+
+func TestHides(t *testing.T) {
+	tests := []struct {
+		whiteout, entry string
+		want            bool
+	}{
+		{"/charts/.wh.a.yaml", "/charts/a.yaml", true},
+		{"/charts/.wh.a.yaml", "/charts/b.yaml", false},
+		{"/charts/.wh.sub", "/charts/sub/a.yaml", true},
+		{"/charts/.wh.sub", "/charts/subway.yaml", false},
+		{"/charts/.wh..wh..opq", "/charts/sub/a.yaml", true},
+		{"/charts/sub/.wh..wh..opq", "/charts/sub/a.yaml", true},
+		{"/charts/sub/.wh..wh..opq", "/charts/a.yaml", false},
+		{"/charts/sub/.wh..wh..opq", "/charts/subway/a.yaml", false},
+	}
+	for _, tt := range tests {
+		if got := hides(tt.whiteout, tt.entry); got != tt.want {
+			t.Errorf("hides(%q, %q) = %v, want %v", tt.whiteout, tt.entry, got, tt.want)
+		}
+	}
+}
+
+// countingLayer counts how often its contents are read.
+type countingLayer struct {
+	v1.Layer
+	reads *int32
+}
+
+func (l countingLayer) Uncompressed() (io.ReadCloser, error) {
+	atomic.AddInt32(l.reads, 1)
+	return l.Layer.Uncompressed()
+}
+
+func TestExtractLayersReadsEachLayerOnce(t *testing.T) {
+	var reads int32
+	layers := []v1.Layer{
+		countingLayer{testLayer(t, testEntry{name: "bin/a", body: "a"}, testEntry{name: "charts/a.yaml", body: "a"}), &reads},
+		countingLayer{testLayer(t, testEntry{name: "bin/b", body: "b"}, testEntry{name: "extra/b", body: "b"}), &reads},
+	}
+
+	dir := tempDir(t)
+	stats, err := extractLayers("test", dir, layers, testExtractOptions("bin", "charts", "extra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reads != 2 {
+		t.Errorf("read layers %d times, want 2", reads)
+	}
+	if stats.Files != 4 {
+		t.Errorf("extracted %d files, want 4", stats.Files)
+	}
+	for _, src := range []string{"bin", "charts", "extra"} {
+		if !stats.found[src] {
+			t.Errorf("%s not found", src)
+		}
+	}
+}
+
+func TestExtractLayersLimits(t *testing.T) {
+	layers := []v1.Layer{
+		testLayer(t, testEntry{name: "bin/a", body: "aaaa"}, testEntry{name: "bin/b", body: "bbbb"}),
+		testLayer(t, testEntry{name: "bin/c", body: "cccc"}, testEntry{name: "bin/d", body: "dddd"}),
+	}
+	// each layer is within the limits, but the image is not
+	for _, limits := range []struct {
+		entries int
+		bytes   int64
+	}{{3, 100}, {100, 12}} {
+		opts := testExtractOptions("bin")
+		opts.limits = &extractLimits{maxEntries: limits.entries, maxBytes: limits.bytes}
+		if _, err := extractLayers("test", tempDir(t), layers, opts); err == nil {
+			t.Errorf("extracted past %d entries and %d bytes", limits.entries, limits.bytes)
+		}
+	}
+
+	opts := testExtractOptions("bin")
+	opts.limits = &extractLimits{maxEntries: 4, maxBytes: 16}
+	if _, err := extractLayers("test", tempDir(t), layers, opts); err != nil {
+		t.Errorf("image within the limits: %v", err)
+	}
+}
+
+func benchmarkLayers(b *testing.B) []v1.Layer {
+	body := strings.Repeat("x", 64<<10)
+	var layers []v1.Layer
+	for i := 0; i < 8; i++ {
+		var entries []testEntry
+		for j := 0; j < 16; j++ {
+			entries = append(entries, testEntry{name: fmt.Sprintf("bin/file-%d-%d", i, j), body: body, mode: 0755})
+		}
+		layers = append(layers, testLayer(b, entries...))
+	}
+	return layers
+}
+
+func BenchmarkExtractFlattened(b *testing.B) {
+	img := testImage(b, benchmarkLayers(b)...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := mutate.Extract(img)
+		if _, err := extract("test", tempDir(b), r, testExtractOptions("bin")); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkExtractLayered(b *testing.B) {
+	layers := benchmarkLayers(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := extractLayers("test", tempDir(b), layers, testExtractOptions("bin")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
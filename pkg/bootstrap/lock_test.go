@@ -0,0 +1,30 @@
+// +build !windows
+
+package bootstrap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStageLockTimeout(t *testing.T) {
+	dataDir := tempDir(t)
+	unlock, err := lockDataDir(dataDir, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Stage(dataDir, testImages, StageOptions{
+		Image:       testRuntimeImage(t),
+		LockTimeout: 200 * time.Millisecond,
+		Logger:      testLogger(),
+	})
+	if err == nil {
+		t.Fatal("staged while another caller held the lock")
+	}
+
+	unlock()
+	if _, err := Stage(dataDir, testImages, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()}); err != nil {
+		t.Fatalf("staging after the lock was released: %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+package bootstrap
+
+import "time"
+
+func lockDataDir(_ string, _ time.Duration) (func(), error) {
+	// not supported in this OS
+	return func() {}, nil
+}
@@ -0,0 +1,24 @@
+// +build !windows
+
+package bootstrap
+
+import (
+	"archive/tar"
+	"os"
+)
+
+// fileMode returns the mode to create the file described by h with. The
+// permission bits from the header are kept, masked by perm, while setuid,
+// setgid and sticky bits are dropped. Files without any permission bits
+// default to 0644, and executables always keep their owner execute bit.
+func fileMode(h *tar.Header, perm os.FileMode) os.FileMode {
+	orig := h.FileInfo().Mode().Perm()
+	if orig == 0 {
+		orig = 0644
+	}
+	mode := orig & perm
+	if orig&0100 != 0 {
+		mode |= 0100
+	}
+	return mode
+}
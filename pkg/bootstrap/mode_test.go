@@ -0,0 +1,99 @@
+// +build !windows
+
+package bootstrap
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	tests := []struct {
+		mode int64
+		perm os.FileMode
+		want os.FileMode
+	}{
+		{0644, os.ModePerm, 0644},
+		{0600, os.ModePerm, 0600},
+		{0700, os.ModePerm, 0700},
+		{0600, 0755, 0600},
+		{0700, 0755, 0700},
+		{0, os.ModePerm, 0644},
+		{0775, os.ModePerm, 0775},
+		{0775, 0755, 0755},
+		{0777, 0750, 0750},
+		{04755, 0755, 0755},
+		{0500, 0055, 0100},
+	}
+	for _, tt := range tests {
+		h := &tar.Header{Name: "file", Mode: tt.mode, Typeflag: tar.TypeReg}
+		if got := fileMode(h, tt.perm); got != tt.want {
+			t.Errorf("fileMode(%o, %s) = %s, want %s", tt.mode, tt.perm, got, tt.want)
+		}
+	}
+}
+
+func TestStageStripsWritableBinModes(t *testing.T) {
+	dataDir := tempDir(t)
+	result, err := StageWithResult(dataDir, testImages, StageOptions{
+		Image: testRuntimeImage(t,
+			testEntry{name: "bin/crictl", body: "crictl", mode: 0777},
+			testEntry{name: "bin/private", body: "private", mode: 0700},
+			testEntry{name: "bin/secret", body: "secret", mode: 0600},
+			testEntry{name: "charts/rke2-coredns.yaml", body: "coredns", mode: 0664},
+			testEntry{name: "charts/rke2-secret.yaml", body: "secret", mode: 0600},
+		),
+		Logger: testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]os.FileMode{
+		filepath.Join(result.BinDir, "crictl"):                    0755,
+		filepath.Join(result.BinDir, "private"):                   0700,
+		filepath.Join(result.BinDir, "secret"):                    0600,
+		filepath.Join(manifestsDir(dataDir), "rke2-coredns.yaml"): 0664,
+		filepath.Join(manifestsDir(dataDir), "rke2-secret.yaml"):  0600,
+	} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want {
+			t.Errorf("%s mode is %s, want %s", name, fi.Mode().Perm(), want)
+		}
+	}
+}
+
+func TestStageManifestsModes(t *testing.T) {
+	dataDir := tempDir(t)
+	if _, err := Stage(dataDir, testImages, StageOptions{
+		Image:             testRuntimeImage(t, testEntry{name: "charts/rke2-coredns.yaml", body: "coredns", mode: 0666}),
+		ManifestsFileMode: 0600,
+		ManifestsDirMode:  0700,
+		Logger:            testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := manifestsDir(dataDir)
+	fi, err := os.Stat(manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Errorf("manifests dir mode is %s, want 0700", fi.Mode().Perm())
+	}
+	for _, name := range listDir(t, manifests) {
+		fi, err := os.Stat(filepath.Join(manifests, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("%s mode is %s, want 0600", name, fi.Mode().Perm())
+		}
+	}
+}
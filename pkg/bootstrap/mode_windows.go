@@ -0,0 +1,13 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"os"
+)
+
+// fileMode returns the mode to create the file described by h with. POSIX
+// permission bits have no meaning on NTFS, so files are always created
+// writable and perm is ignored.
+func fileMode(_ *tar.Header, _ os.FileMode) os.FileMode {
+	return 0755
+}
@@ -0,0 +1,15 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestFileMode(t *testing.T) {
+	for _, mode := range []int64{0, 0444, 0644, 0755} {
+		h := &tar.Header{Name: "file.exe", Mode: mode, Typeflag: tar.TypeReg}
+		if got := fileMode(h, 0700); got != 0755 {
+			t.Errorf("fileMode(%o) = %s, want 0755", mode, got)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package bootstrap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// rename is os.Rename, replaceable so that moves across filesystems can be
+// simulated.
+var rename = os.Rename
+
+// moveDir moves the contents of src into dest. If dest does not exist src is
+// renamed as a whole, otherwise each file is moved individually and existing
+// files of the same name are handled according to opts.Overwrite. Moves
+// across filesystems fall back to copying. Everything moved, and dest itself,
+// is given to opts.Owner if it is set. Nothing is moved if the policy is
+// OverwriteFail and any of the files already exist.
+func moveDir(src, dest string, opts StageOptions) error {
+	if err := checkOverwrite(src, dest, opts); err != nil {
+		return err
+	}
+	if !dirExists(dest) {
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		err := rename(src, dest)
+		if err == nil {
+			return chownDir(dest, opts.Owner)
+		} else if !isCrossDevice(err) {
+			return err
+		}
+		if err := os.Mkdir(dest, 0755); err != nil {
+			return err
+		}
+	}
+
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		srcFile, destFile := filepath.Join(src, f.Name()), filepath.Join(dest, f.Name())
+		if opts.Overwrite != OverwriteReplace {
+			if _, err := os.Lstat(destFile); err == nil {
+				if opts.Overwrite == OverwriteFail {
+					return fmt.Errorf("refusing to overwrite existing file %s", destFile)
+				}
+				opts.logger().Infof("Keeping existing file %s", destFile)
+				continue
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := moveFile(srcFile, destFile); err != nil {
+			return err
+		}
+		if opts.Owner != nil {
+			if err := lchown(destFile, opts.Owner); err != nil {
+				return err
+			}
+		}
+	}
+	if opts.Owner != nil {
+		return lchown(dest, opts.Owner)
+	}
+	return nil
+}
+
+// checkOverwrite returns an error if the policy in opts is OverwriteFail and
+// any file in src already exists in dest.
+func checkOverwrite(src, dest string, opts StageOptions) error {
+	if opts.Overwrite != OverwriteFail || !dirExists(dest) {
+		return nil
+	}
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		destFile := filepath.Join(dest, f.Name())
+		if _, err := os.Lstat(destFile); err == nil {
+			return fmt.Errorf("refusing to overwrite existing file %s", destFile)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// chownDir gives dir and the files in it to owner, if it is set.
+func chownDir(dir string, owner *FileOwner) error {
+	if owner == nil {
+		return nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := lchown(filepath.Join(dir, f.Name()), owner); err != nil {
+			return err
+		}
+	}
+	return lchown(dir, owner)
+}
+
+// dedupBinDir replaces each file in binDir with a hardlink to an identical
+// file of the same name in the bin dir of another runtime staged in dataDir.
+// Files are left as they are if linking fails.
+func dedupBinDir(dataDir, binDir string, opts StageOptions) error {
+	runtimes, err := StagedRuntimes(dataDir)
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(binDir)
+	if err != nil {
+		return err
+	}
+
+	linked := 0
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		file := filepath.Join(binDir, f.Name())
+		for _, runtime := range runtimes {
+			if runtime.BinDir == binDir {
+				continue
+			}
+			other := filepath.Join(runtime.BinDir, f.Name())
+			if same, err := sameFile(other, file); err != nil || !same {
+				continue
+			}
+			if err := replaceWithLink(other, file); err != nil {
+				opts.logger().Debugf("Failed to link %s to %s: %v", file, other, err)
+				continue
+			}
+			linked++
+			break
+		}
+	}
+	if linked > 0 {
+		opts.logger().Infof("Hardlinked %d files in %s to identical files in other staged runtimes", linked, binDir)
+	}
+	return nil
+}
+
+// replaceWithLink atomically replaces dest with a hardlink to src.
+func replaceWithLink(src, dest string) error {
+	tmp := dest + ".link"
+	_ = os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// checkWritable creates dir if needed and checks that files can be created
+// in it.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".write-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// sameFile reports whether a and b are both regular files with the same mode
+// and contents. A missing b is not an error.
+func sameFile(a, b string) (bool, error) {
+	aInfo, err := os.Lstat(a)
+	if err != nil {
+		return false, err
+	}
+	bInfo, err := os.Lstat(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !aInfo.Mode().IsRegular() || aInfo.Mode() != bInfo.Mode() || aInfo.Size() != bInfo.Size() {
+		return false, nil
+	}
+
+	aSum, err := fileChecksum(a)
+	if err != nil {
+		return false, err
+	}
+	bSum, err := fileChecksum(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aSum, bSum), nil
+}
+
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// moveFile renames src to dest, copying it instead if they are on different
+// filesystems. Symlinks are recreated rather than copied.
+func moveFile(src, dest string) error {
+	err := rename(src, dest)
+	if !isCrossDevice(err) {
+		return err
+	}
+
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		err = copySymlink(src, dest)
+	} else {
+		// don't write through a symlink left at dest by an earlier stage
+		if destInfo, err := os.Lstat(dest); err == nil && destInfo.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(dest); err != nil {
+				return err
+			}
+		}
+		err = copyFile(src, dest)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// linkOrCopy hardlinks src to dest, copying it instead if it cannot be
+// linked.
+func linkOrCopy(src, dest string) error {
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	return copyFile(src, dest)
+}
+
+func copySymlink(src, dest string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, dest)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dest, fi.Mode())
+}
+
+func isCrossDevice(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		return le.Err == syscall.EXDEV
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/rancher/rke2/pkg/images"
+)
+
+// crossDevice makes every rename fail as if it crossed filesystems until the
+// test ends.
+func crossDevice(t *testing.T) {
+	rename = func(src, dest string) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dest, Err: syscall.EXDEV}
+	}
+	t.Cleanup(func() { rename = os.Rename })
+}
+
+func TestMoveDirCrossDevice(t *testing.T) {
+	crossDevice(t)
+	for _, existing := range []bool{false, true} {
+		src := filepath.Join(tempDir(t), "src")
+		dest := filepath.Join(tempDir(t), "dest")
+		writeFile(t, filepath.Join(src, "containerd"), "containerd", 0755)
+		writeFile(t, filepath.Join(src, "kubelet"), "kubelet", 0755)
+		if existing {
+			writeFile(t, filepath.Join(dest, "kubelet"), "old", 0644)
+		}
+
+		if err := moveDir(src, dest, StageOptions{Logger: testLogger()}); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := listDir(t, dest), []string{"containerd", "kubelet"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got := readFile(t, filepath.Join(dest, "kubelet")); got != "kubelet" {
+			t.Errorf("got %q, want kubelet", got)
+		}
+		if fi, err := os.Stat(filepath.Join(dest, "containerd")); err != nil {
+			t.Error(err)
+		} else if runtime.GOOS != "windows" && fi.Mode().Perm() != 0755 {
+			t.Errorf("copy has mode %s, want 0755", fi.Mode().Perm())
+		}
+		if got := listDir(t, src); len(got) != 0 {
+			t.Errorf("source still has %v", got)
+		}
+	}
+}
+
+func TestMoveDirCrossDeviceSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	crossDevice(t)
+	src := filepath.Join(tempDir(t), "src")
+	dest := filepath.Join(tempDir(t), "dest")
+	writeFile(t, filepath.Join(src, "containerd"), "containerd", 0755)
+	if err := os.Symlink("containerd", filepath.Join(src, "ctr")); err != nil {
+		t.Fatal(err)
+	}
+	// an earlier symlink at dest must be replaced rather than written through
+	writeFile(t, filepath.Join(dest, "runc"), "runc", 0755)
+	if err := os.Symlink("runc", filepath.Join(dest, "containerd")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveDir(src, dest, StageOptions{Logger: testLogger()}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.Readlink(filepath.Join(dest, "ctr")); err != nil || got != "containerd" {
+		t.Errorf("ctr links to %q (%v), want containerd", got, err)
+	}
+	if got := readFile(t, filepath.Join(dest, "runc")); got != "runc" {
+		t.Errorf("runc was written through a symlink: %q", got)
+	}
+	if got := readFile(t, filepath.Join(dest, "containerd")); got != "containerd" {
+		t.Errorf("got %q, want containerd", got)
+	}
+}
+
+func TestStageHardlinkDuplicates(t *testing.T) {
+	dataDir := tempDir(t)
+	first, err := Stage(dataDir, testImages, StageOptions{
+		Image:  testRuntimeImage(t, testEntry{name: "bin/crictl", body: "v1", mode: 0755}),
+		Logger: testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Stage(dataDir, images.Images{Runtime: "rancher/rke2-runtime:v1.18.5"}, StageOptions{
+		Image:              testRuntimeImage(t, testEntry{name: "bin/crictl", body: "v2", mode: 0755}),
+		HardlinkDuplicates: true,
+		Logger:             testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range listDir(t, second) {
+		a, err := os.Stat(filepath.Join(first, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(filepath.Join(second, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := os.SameFile(a, b), name != "crictl"; got != want {
+			t.Errorf("%s is shared between runtimes: %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestStageOverwritePolicy(t *testing.T) {
+	tests := []struct {
+		policy OverwritePolicy
+		want   string
+		fail   bool
+	}{
+		{OverwriteReplace, "canal", false},
+		{OverwriteSkip, "edited", false},
+		{OverwriteFail, "edited", true},
+	}
+	for _, tt := range tests {
+		dataDir := tempDir(t)
+		chart := filepath.Join(manifestsDir(dataDir), "rke2-canal.yaml")
+		writeFile(t, chart, "edited", 0644)
+		_, err := Stage(dataDir, testImages, StageOptions{
+			Image:     testRuntimeImage(t),
+			Overwrite: tt.policy,
+			Logger:    testLogger(),
+		})
+		if (err != nil) != tt.fail {
+			t.Errorf("policy %q: got error %v", tt.policy, err)
+		}
+		if got := readFile(t, chart); got != tt.want {
+			t.Errorf("policy %q: got chart %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestMoveDirOverwriteFail(t *testing.T) {
+	src := filepath.Join(tempDir(t), "src")
+	dest := filepath.Join(tempDir(t), "dest")
+	writeFile(t, filepath.Join(src, "rke2-aaa.yaml"), "aaa", 0644)
+	writeFile(t, filepath.Join(src, "rke2-canal.yaml"), "canal", 0644)
+	writeFile(t, filepath.Join(src, "rke2-zzz.yaml"), "zzz", 0644)
+	writeFile(t, filepath.Join(dest, "rke2-canal.yaml"), "edited", 0644)
+
+	if err := moveDir(src, dest, StageOptions{Overwrite: OverwriteFail, Logger: testLogger()}); err == nil {
+		t.Fatal("overwrote an existing file")
+	}
+	if got, want := listDir(t, dest), []string{"rke2-canal.yaml"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dest has %v after the conflict, want %v", got, want)
+	}
+	if got := readFile(t, filepath.Join(dest, "rke2-canal.yaml")); got != "edited" {
+		t.Errorf("got %q, want edited", got)
+	}
+}
+
+func TestStageOverwriteFailLeavesDestinations(t *testing.T) {
+	dataDir := tempDir(t)
+	extraDir := filepath.Join(tempDir(t), "share")
+	writeFile(t, filepath.Join(extraDir, "README"), "edited", 0644)
+	_, err := Stage(dataDir, testImages, StageOptions{
+		Image: testRuntimeImage(t,
+			testEntry{name: "charts/rke2-aaa.yaml", body: "aaa"},
+			testEntry{name: "share/README", body: "readme"},
+		),
+		ExtraExtractPaths: map[string]string{"share": extraDir},
+		Overwrite:         OverwriteFail,
+		Logger:            testLogger(),
+	})
+	if err == nil {
+		t.Fatal("overwrote an existing file")
+	}
+	if got := listDir(t, manifestsDir(dataDir)); len(got) != 0 {
+		t.Errorf("manifests dir has %v after the conflict", got)
+	}
+	if got := readFile(t, filepath.Join(extraDir, "README")); got != "edited" {
+		t.Errorf("got README %q, want edited", got)
+	}
+}
@@ -0,0 +1,177 @@
+package bootstrap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rancher/rke2/pkg/images"
+)
+
+// pullImage pulls ref from its registry. If that fails, the mirrors configured
+// for the registry in the private registry configuration are tried in order,
+// followed by the default runtime reference if opts.FallbackToDefaultRegistry
+// is set. Each registry is accessed with the credentials configured for it.
+// Nothing is pulled if opts.Offline is set.
+func pullImage(ref name.Reference, opts StageOptions) (v1.Image, error) {
+	if opts.Offline {
+		return nil, fmt.Errorf("runtime image %s not found locally and offline mode is set", ref)
+	}
+
+	config, err := loadRegistryConfig(opts.PrivateRegistry)
+	if err != nil {
+		opts.logger().Warnf("Failed to load private registry configuration %s: %v", opts.PrivateRegistry, err)
+		config = &registryConfig{}
+	}
+
+	img, err := fetchImage(ref, config, opts)
+	if err == nil {
+		return img, nil
+	}
+
+	for _, mirror := range mirrorReferences(ref, config) {
+		opts.logger().Warnf("Failed to pull %s, trying mirror %s: %v", ref, mirror, err)
+		img, mirrorErr := fetchImage(mirror, config, opts)
+		if mirrorErr != nil {
+			opts.logger().Warnf("Failed to pull %s: %v", mirror, mirrorErr)
+			continue
+		}
+		opts.logger().Infof("Pulled %s from mirror %s", ref, mirror.Context().RegistryStr())
+		return img, nil
+	}
+	return pullDefault(ref, config, err, opts)
+}
+
+// pullDefault pulls the default runtime image reference after ref failed to
+// pull with err. err is returned unchanged if the fallback is disabled or
+// does not apply to ref.
+func pullDefault(ref name.Reference, config *registryConfig, err error, opts StageOptions) (v1.Image, error) {
+	if !opts.FallbackToDefaultRegistry {
+		return nil, err
+	}
+	defaultRef, perr := name.ParseReference(images.New("").Runtime)
+	if perr != nil || defaultRef.Name() == ref.Name() {
+		return nil, err
+	}
+
+	opts.logger().Warnf("Failed to pull %s, trying default %s: %v", ref, defaultRef, err)
+	img, defaultErr := fetchImage(defaultRef, config, opts)
+	if defaultErr != nil {
+		opts.logger().Warnf("Failed to pull %s: %v", defaultRef, defaultErr)
+		return nil, err
+	}
+	opts.logger().Infof("Pulled %s from default %s", ref, defaultRef)
+	return img, nil
+}
+
+// fetchImage fetches ref from its registry, provided the registry is allowed
+// by opts.AllowedRegistries, using the settings config has for the registry.
+func fetchImage(ref name.Reference, config *registryConfig, opts StageOptions) (v1.Image, error) {
+	if !registryAllowed(ref, opts.AllowedRegistries) {
+		return nil, fmt.Errorf("registry %s of %s is not an allowed registry", ref.Context().RegistryStr(), ref)
+	}
+	options, err := remoteOptions(opts, config.host(ref.Context().RegistryStr()))
+	if err != nil {
+		return nil, err
+	}
+	return remote.Image(ref, options...)
+}
+
+// registryAllowed reports whether the registry of ref is one of allowed. An
+// empty list allows every registry.
+func registryAllowed(ref name.Reference, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	registry := ref.Context().RegistryStr()
+	for _, host := range allowed {
+		if host == registry || (host == "docker.io" && registry == name.DefaultRegistry) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuntimeImageSize returns the total compressed size of the runtime image
+// layers, which is roughly how much Stage will download to pull it. Only the
+// image manifest is fetched.
+func RuntimeImageSize(images images.Images, opts StageOptions) (int64, error) {
+	ref, _, err := EffectiveRuntimeReference(images, opts)
+	if err != nil {
+		return 0, err
+	}
+	img, err := pullImage(ref, opts)
+	if err != nil {
+		return 0, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return size, nil
+}
+
+// remoteOptions returns the options used for registry requests made by Stage
+// to a registry configured with host. Credentials configured for the
+// registry take precedence over the keychains.
+func remoteOptions(opts StageOptions, host registryHost) ([]remote.Option, error) {
+	t, err := transport(opts, host.TLS)
+	if err != nil {
+		return nil, err
+	}
+	auth := remote.WithAuthFromKeychain(authn.NewMultiKeychain(keychains(opts)...))
+	if host.Auth != nil {
+		auth = remote.WithAuth(host.Auth.authenticator())
+	}
+
+	return []remote.Option{
+		auth,
+		remote.WithTransport(t),
+		// pick the image for this node from multi-platform runtime images
+		remote.WithPlatform(v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}),
+	}, nil
+}
+
+// keychains returns the keychains consulted for registry credentials, in
+// order.
+func keychains(opts StageOptions) []authn.Keychain {
+	keychains := make([]authn.Keychain, 0, len(opts.ExtraKeychains)+1)
+	keychains = append(keychains, opts.ExtraKeychains...)
+	return append(keychains, authn.DefaultKeychain)
+}
+
+// transport returns the transport used for requests to a registry with the
+// TLS settings config, which may be nil. Unless overridden, it honors the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func transport(opts StageOptions, config *registryTLS) (http.RoundTripper, error) {
+	if opts.Transport != nil {
+		return opts.Transport, nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	if config != nil {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = tlsConfig
+	}
+	if opts.InsecureSkipTLSVerify {
+		opts.logger().Warn("Registry TLS certificate verification is disabled for runtime image pulls")
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return t, nil
+}
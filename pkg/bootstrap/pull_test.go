@@ -0,0 +1,665 @@
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/sirupsen/logrus"
+)
+
+// testRegistry starts a registry serving img as repo, which includes the
+// tag, and returns the full reference to it.
+func testRegistry(t *testing.T, repo string, img v1.Image) string {
+	t.Helper()
+	s := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pushImage(t, u.Host+"/"+repo, img)
+}
+
+func pushImage(t *testing.T, image string, img v1.Image) string {
+	t.Helper()
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func TestStageMetrics(t *testing.T) {
+	ref := testRegistry(t, "rancher/rke2-runtime:v1.18.4", testRuntimeImage(t))
+
+	metrics := &StageMetrics{}
+	if _, err := Stage(tempDir(t), images.Images{Runtime: ref}, StageOptions{
+		Metrics: metrics,
+		Logger:  testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.Source != ImageSourceRemote {
+		t.Errorf("source is %q, want %q", metrics.Source, ImageSourceRemote)
+	}
+	if metrics.ResolveDuration <= 0 {
+		t.Errorf("resolve duration is %s", metrics.ResolveDuration)
+	}
+	if metrics.ExtractDuration <= 0 {
+		t.Errorf("extract duration is %s", metrics.ExtractDuration)
+	}
+	if want := len(requiredBinaries) + 1; metrics.FilesExtracted != want {
+		t.Errorf("extracted %d files, want %d", metrics.FilesExtracted, want)
+	}
+	if metrics.BytesExtracted == 0 {
+		t.Error("extracted no bytes")
+	}
+}
+
+// basicAuth requires the username user and password pass for every request
+// to h.
+func basicAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeRegistries(t *testing.T, config string) string {
+	t.Helper()
+	file := filepath.Join(tempDir(t), "registries.yaml")
+	writeFile(t, file, config, 0600)
+	return file
+}
+
+func TestStagePullsFromMirrorWithAuth(t *testing.T) {
+	s := httptest.NewServer(basicAuth(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(u.Host + "/rancher/rke2-runtime:v1.18.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, testRuntimeImage(t), remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing listens on the primary registry
+	runtimeImages := images.Images{Runtime: "127.0.0.1:1/rancher/rke2-runtime:v1.18.4"}
+	mirrors := fmt.Sprintf(`
+mirrors:
+  "127.0.0.1:1":
+    endpoint: ["http://%s"]
+`, u.Host)
+
+	_, err = Stage(tempDir(t), runtimeImages, StageOptions{
+		PrivateRegistry: writeRegistries(t, mirrors),
+		Logger:          testLogger(),
+	})
+	if _, ok := err.(*PullError); !ok {
+		t.Fatalf("got error %v without credentials, want a PullError", err)
+	}
+
+	auth := fmt.Sprintf(`
+configs:
+  "%s":
+    auth:
+      username: user
+      password: pass
+`, u.Host)
+	result, err := StageWithResult(tempDir(t), runtimeImages, StageOptions{
+		PrivateRegistry: writeRegistries(t, mirrors+auth),
+		Logger:          testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != ImageSourceRemote {
+		t.Errorf("source is %q, want %q", result.Source, ImageSourceRemote)
+	}
+}
+
+func TestRegistryConfigHost(t *testing.T) {
+	config := &registryConfig{Configs: map[string]registryHost{
+		"docker.io":        {Auth: &registryAuth{Username: "hub"}},
+		"registry.example": {Auth: &registryAuth{Username: "example"}},
+	}}
+	for registry, want := range map[string]string{
+		name.DefaultRegistry: "hub",
+		"registry.example":   "example",
+		"other.example":      "",
+	} {
+		var got string
+		if auth := config.host(registry).Auth; auth != nil {
+			got = auth.Username
+		}
+		if got != want {
+			t.Errorf("%s: got user %q, want %q", registry, got, want)
+		}
+	}
+}
+
+// tlsRegistry starts a registry serving a runtime image over TLS with a
+// certificate that is not trusted by default, and returns the server and the
+// reference to the image.
+func tlsRegistry(t *testing.T) (*httptest.Server, name.Reference) {
+	t.Helper()
+	s := httptest.NewUnstartedServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	// pulls that don't trust the certificate fail the handshake
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(u.Host + "/rancher/rke2-runtime:v1.18.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, testRuntimeImage(t), remote.WithTransport(s.Client().Transport)); err != nil {
+		t.Fatal(err)
+	}
+	return s, ref
+}
+
+func TestStagePullsWithRegistryTLS(t *testing.T) {
+	s, ref := tlsRegistry(t)
+	runtimeImages := images.Images{Runtime: ref.String()}
+
+	_, err := Stage(tempDir(t), runtimeImages, StageOptions{Logger: testLogger()})
+	if _, ok := err.(*PullError); !ok {
+		t.Fatalf("got error %v without the registry CA, want a PullError", err)
+	}
+
+	caFile := filepath.Join(tempDir(t), "ca.pem")
+	writeFile(t, caFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})), 0644)
+	config := fmt.Sprintf(`
+configs:
+  "%s":
+    tls:
+      ca_file: %s
+`, ref.Context().RegistryStr(), caFile)
+	if _, err := Stage(tempDir(t), runtimeImages, StageOptions{
+		PrivateRegistry: writeRegistries(t, config),
+		Logger:          testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStageInsecureSkipTLSVerify(t *testing.T) {
+	_, ref := tlsRegistry(t)
+	if _, err := Stage(tempDir(t), images.Images{Runtime: ref.String()}, StageOptions{
+		InsecureSkipTLSVerify: true,
+		Logger:                testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// connectProxy is an HTTPS proxy that records the hosts it is asked to
+// connect to and tunnels every connection to the address target.
+type connectProxy struct {
+	target string
+	mu     sync.Mutex
+	hosts  []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.hosts = append(p.hosts, r.Host)
+	p.mu.Unlock()
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestStagePullsThroughProxy(t *testing.T) {
+	// net/http reads the proxy environment only once per process, so the
+	// pull is made by a copy of the test binary started with it set
+	if image := os.Getenv("BOOTSTRAP_TEST_PROXY_IMAGE"); image != "" {
+		if _, err := Stage(tempDir(t), images.Images{Runtime: image}, StageOptions{
+			InsecureSkipTLSVerify: true,
+			Logger:                testLogger(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	s, ref := tlsRegistry(t)
+	proxy := &connectProxy{target: s.Listener.Addr().String()}
+	ps := httptest.NewServer(proxy)
+	t.Cleanup(ps.Close)
+
+	// the registry host does not resolve, so it can only be reached
+	// through the proxy
+	const host = "registry.invalid:5000"
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasSuffix(strings.ToUpper(strings.SplitN(kv, "=", 2)[0]), "_PROXY") {
+			env = append(env, kv)
+		}
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestStagePullsThroughProxy$")
+	cmd.Env = append(env,
+		"BOOTSTRAP_TEST_PROXY_IMAGE="+host+"/"+ref.Context().RepositoryStr()+":"+ref.Identifier(),
+		"HTTPS_PROXY="+ps.URL,
+		"HTTP_PROXY="+ps.URL,
+		"NO_PROXY=",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("pull through the proxy failed: %v\n%s", err, out)
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if len(proxy.hosts) == 0 {
+		t.Fatal("the proxy saw no requests")
+	}
+	for _, h := range proxy.hosts {
+		if h != host {
+			t.Errorf("the proxy was asked for %s, want %s", h, host)
+		}
+	}
+}
+
+// platformImage returns a runtime image built for os/arch, with a chart
+// named after the platform.
+func platformImage(t *testing.T, os, arch string) v1.Image {
+	t.Helper()
+	img := testImage(t, testLayer(t, append(testBinaries(),
+		testEntry{name: "charts/" + os + "-" + arch + ".yaml", body: os})...))
+	config, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	platformConfig := *config
+	platformConfig.OS = os
+	platformConfig.Architecture = arch
+	img, err = mutate.ConfigFile(img, &platformConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestStagePullsImageForPlatform(t *testing.T) {
+	other := "arm"
+	if runtime.GOARCH == other {
+		other = "s390x"
+	}
+	var index v1.ImageIndex = empty.Index
+	for _, p := range []v1.Platform{{OS: "linux", Architecture: other}, {OS: runtime.GOOS, Architecture: runtime.GOARCH}} {
+		p := p
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        platformImage(t, p.OS, p.Architecture),
+			Descriptor: v1.Descriptor{Platform: &p},
+		})
+	}
+
+	s := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(u.Host + "/rancher/rke2-runtime:v1.18.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, index); err != nil {
+		t.Fatal(err)
+	}
+
+	dataDir := tempDir(t)
+	if _, err := Stage(dataDir, images.Images{Runtime: ref.String()}, StageOptions{
+		FailOnPlatformMismatch: true,
+		Logger:                 testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listDir(t, manifestsDir(dataDir)), runtime.GOOS+"-"+runtime.GOARCH+".yaml"; len(got) != 1 || got[0] != want {
+		t.Errorf("manifests are %v, want %s", got, want)
+	}
+}
+
+func TestStageSkipsPullWhenStaged(t *testing.T) {
+	s := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtimeImages := images.Images{Runtime: pushImage(t, u.Host+"/rancher/rke2-runtime:v1.18.4", testRuntimeImage(t))}
+
+	dataDir := tempDir(t)
+	first, err := StageWithResult(dataDir, runtimeImages, StageOptions{Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the registry is gone, so staging again must not contact it
+	s.Close()
+	second, err := StageWithResult(dataDir, runtimeImages, StageOptions{Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Source != ImageSourceStaged || second.BinDir != first.BinDir {
+		t.Errorf("got %+v, want %s to be reused", second, first.BinDir)
+	}
+}
+
+func TestKeychains(t *testing.T) {
+	extra := []authn.Keychain{authn.NewMultiKeychain(), authn.NewMultiKeychain()}
+	got := keychains(StageOptions{ExtraKeychains: extra})
+	if len(got) != 3 || got[0] != extra[0] || got[1] != extra[1] || got[2] != authn.DefaultKeychain {
+		t.Errorf("got %v, want the extra keychains before the default one", got)
+	}
+}
+
+func TestStageAuthenticatesWithKeychains(t *testing.T) {
+	s := httptest.NewServer(basicAuth(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0)))))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(u.Host + "/rancher/rke2-runtime:v1.18.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, testRuntimeImage(t), remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// the default keychain reads the docker config, which has no
+	// credentials, so only the extra keychain can authenticate the pull
+	configDir := tempDir(t)
+	setenv(t, "DOCKER_CONFIG", configDir)
+	keychain := &stubKeychain{auth: &authn.Basic{Username: "user", Password: "pass"}}
+	if _, err := Stage(tempDir(t), images.Images{Runtime: ref.String()}, StageOptions{
+		ExtraKeychains: []authn.Keychain{keychain},
+		Logger:         testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keychain.resolved) == 0 || keychain.resolved[0] != u.Host {
+		t.Errorf("extra keychain resolved %v, want %s", keychain.resolved, u.Host)
+	}
+
+	// the extra keychain is consulted before the default one, so wrong
+	// credentials in the docker config are not used
+	writeFile(t, filepath.Join(configDir, "config.json"), fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`,
+		u.Host, base64.StdEncoding.EncodeToString([]byte("user:wrong"))), 0600)
+	if _, err := Stage(tempDir(t), images.Images{Runtime: ref.String()}, StageOptions{
+		ExtraKeychains: []authn.Keychain{keychain},
+		Logger:         testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stubKeychain returns auth for every registry, recording the registries it
+// is asked for.
+type stubKeychain struct {
+	auth     authn.Authenticator
+	mu       sync.Mutex
+	resolved []string
+}
+
+func (k *stubKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.resolved = append(k.resolved, target.RegistryStr())
+	return k.auth, nil
+}
+
+// setenv sets the environment variable key to value until the test ends.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestPullDefault(t *testing.T) {
+	// nothing listens on the registry, and only it is allowed so that the
+	// default reference is refused rather than pulled from the internet
+	ref, err := name.ParseReference("127.0.0.1:1/rancher/rke2-runtime:v1.18.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pull := func(fallback bool) (string, error) {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		logger := logrus.New()
+		logger.Out = buf
+		_, err := pullImage(ref, StageOptions{
+			FallbackToDefaultRegistry: fallback,
+			AllowedRegistries:         []string{"127.0.0.1:1"},
+			Logger:                    logrus.NewEntry(logger),
+		})
+		return buf.String(), err
+	}
+
+	out, err := pull(false)
+	if err == nil {
+		t.Fatal("pulled from a dead registry")
+	}
+	if strings.Contains(out, "trying default") {
+		t.Errorf("tried the default reference with the fallback disabled:\n%s", out)
+	}
+
+	out, err = pull(true)
+	if err == nil {
+		t.Fatal("pulled a disallowed default reference")
+	}
+	if !strings.Contains(out, "trying default "+images.New("").Runtime) {
+		t.Errorf("did not try the default reference:\n%s", out)
+	}
+	if !strings.Contains(err.Error(), "127.0.0.1:1") {
+		t.Errorf("got error %v, want the error pulling the configured reference", err)
+	}
+}
+
+func TestRuntimeImageSize(t *testing.T) {
+	img := testImage(t,
+		testLayer(t, testBinaries()...),
+		testLayer(t, testEntry{name: "charts/rke2-canal.yaml", body: "canal"}),
+	)
+	ref := testRegistry(t, "rancher/rke2-runtime:v1.18.4", img)
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want int64
+	for _, layer := range manifest.Layers {
+		want += layer.Size
+	}
+
+	size, err := RuntimeImageSize(images.Images{Runtime: ref}, StageOptions{Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != want || size == 0 {
+		t.Errorf("got size %d, want %d", size, want)
+	}
+}
+
+func TestStageLogsImageSource(t *testing.T) {
+	ref := testRegistry(t, "rancher/rke2-runtime:v1.18.4", testRuntimeImage(t))
+	dataDir := tempDir(t)
+	tests := []struct {
+		image images.Images
+		opts  StageOptions
+		want  string
+	}{
+		{testImages, StageOptions{Image: testRuntimeImage(t)}, "Using provided runtime image"},
+		{testImages, StageOptions{}, "already staged"},
+		{images.Images{Runtime: ref}, StageOptions{}, "Resolved runtime image " + ref + " in registry"},
+	}
+	for _, tt := range tests {
+		buf := &bytes.Buffer{}
+		logger := logrus.New()
+		logger.Out = buf
+		tt.opts.Logger = logrus.NewEntry(logger)
+		if _, err := Stage(dataDir, tt.image, tt.opts); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), tt.want) {
+			t.Errorf("log is missing %q:\n%s", tt.want, buf)
+		}
+	}
+}
+
+func TestStageOffline(t *testing.T) {
+	ref := testRegistry(t, "rancher/rke2-runtime:v1.18.4", testRuntimeImage(t))
+	dataDir := tempDir(t)
+	if _, err := Stage(dataDir, images.Images{Runtime: ref}, StageOptions{Offline: true, Logger: testLogger()}); err == nil {
+		t.Fatal("pulled the runtime image in offline mode")
+	}
+
+	// a provided or already staged image needs no registry
+	if _, err := Stage(dataDir, testImages, StageOptions{Image: testRuntimeImage(t), Offline: true, Logger: testLogger()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Stage(dataDir, testImages, StageOptions{Offline: true, Logger: testLogger()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryAllowed(t *testing.T) {
+	tests := []struct {
+		image   string
+		allowed []string
+		want    bool
+	}{
+		{"rancher/rke2-runtime:v1.18.4", nil, true},
+		{"rancher/rke2-runtime:v1.18.4", []string{"docker.io"}, true},
+		{"rancher/rke2-runtime:v1.18.4", []string{"index.docker.io"}, true},
+		{"rancher/rke2-runtime:v1.18.4", []string{"registry.example.com"}, false},
+		{"registry.example.com:5000/rancher/rke2-runtime:v1.18.4", []string{"registry.example.com"}, false},
+		{"registry.example.com:5000/rancher/rke2-runtime:v1.18.4", []string{"registry.example.com:5000"}, true},
+	}
+	for _, tt := range tests {
+		ref, err := name.ParseReference(tt.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := registryAllowed(ref, tt.allowed); got != tt.want {
+			t.Errorf("registryAllowed(%s, %v) = %v, want %v", tt.image, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestStageAllowedRegistries(t *testing.T) {
+	ref := testRegistry(t, "rancher/rke2-runtime:v1.18.4", testRuntimeImage(t))
+	runtimeImages := images.Images{Runtime: ref}
+	if _, err := Stage(tempDir(t), runtimeImages, StageOptions{
+		AllowedRegistries: []string{"registry.example.com"},
+		Logger:            testLogger(),
+	}); err == nil {
+		t.Error("pulled from a registry that is not allowed")
+	}
+
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Stage(tempDir(t), runtimeImages, StageOptions{
+		AllowedRegistries: []string{parsed.Context().RegistryStr()},
+		Logger:            testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStageLocalSource(t *testing.T) {
+	// nothing listens on the registry, so the image must come from the
+	// local source
+	runtimeImages := images.Images{Runtime: "127.0.0.1:1/rancher/rke2-runtime:v1.18.4"}
+	var asked name.Reference
+	local := func(ref name.Reference) (v1.Image, error) {
+		asked = ref
+		return testRuntimeImage(t), nil
+	}
+	result, err := StageWithResult(tempDir(t), runtimeImages, StageOptions{LocalSource: local, Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != ImageSourceLocal || asked == nil || asked.String() != runtimeImages.Runtime {
+		t.Errorf("got %+v after asking for %v, want the local image", result, asked)
+	}
+
+	// a local source without the image, or failing, falls back to pulling
+	for _, local := range []func(name.Reference) (v1.Image, error){
+		func(name.Reference) (v1.Image, error) { return nil, nil },
+		func(name.Reference) (v1.Image, error) { return nil, fmt.Errorf("store unavailable") },
+	} {
+		_, err := Stage(tempDir(t), runtimeImages, StageOptions{LocalSource: local, Logger: testLogger()})
+		if _, ok := err.(*PullError); !ok {
+			t.Errorf("got error %v, want a PullError", err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package bootstrap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+	"github.com/rancher/wrangler/pkg/merr"
+	"sigs.k8s.io/yaml"
+)
+
+// registryConfig is the subset of the private registry configuration
+// (registries.yaml) that is needed to pull the runtime image.
+type registryConfig struct {
+	Mirrors map[string]registryMirror `json:"mirrors"`
+	Configs map[string]registryHost   `json:"configs"`
+}
+
+type registryMirror struct {
+	Endpoints []string `json:"endpoint"`
+}
+
+type registryHost struct {
+	Auth *registryAuth `json:"auth"`
+	TLS  *registryTLS  `json:"tls"`
+}
+
+type registryAuth struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identity_token"`
+}
+
+type registryTLS struct {
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// ValidatePrivateRegistries checks the parts of the private registry
+// configuration at path that Stage uses: that it can be parsed, that its
+// mirror endpoints are valid URLs, that any credentials are complete and that
+// the TLS certificates and keys it references can be loaded. A missing file
+// is valid, as Stage treats it as empty.
+func ValidatePrivateRegistries(path string) error {
+	config, err := loadRegistryConfig(path)
+	if err != nil {
+		return errors.Wrapf(err, "invalid private registry configuration %s", path)
+	}
+
+	var errs []error
+	for registry, mirror := range config.Mirrors {
+		for _, endpoint := range mirror.Endpoints {
+			if host, _ := endpointHost(endpoint); host == "" {
+				errs = append(errs, fmt.Errorf("mirror %s: invalid endpoint %q", registry, endpoint))
+			}
+		}
+	}
+	for registry, host := range config.Configs {
+		if auth := host.Auth; auth != nil {
+			if auth.Auth == "" && auth.IdentityToken == "" && (auth.Username == "" || auth.Password == "") {
+				errs = append(errs, fmt.Errorf("config %s: auth needs a username and password, auth or identity_token", registry))
+			}
+		}
+		if tls := host.TLS; tls != nil {
+			if (tls.CertFile == "") != (tls.KeyFile == "") {
+				errs = append(errs, fmt.Errorf("config %s: cert_file and key_file must be set together", registry))
+			} else if _, err := tls.tlsConfig(); err != nil {
+				errs = append(errs, errors.Wrapf(err, "config %s", registry))
+			}
+		}
+	}
+	return merr.NewErrors(errs...)
+}
+
+// host returns the settings configured for registry. Settings for docker.io
+// apply to the default registry.
+func (c *registryConfig) host(registry string) registryHost {
+	host, ok := c.Configs[registry]
+	if !ok && registry == name.DefaultRegistry {
+		host = c.Configs["docker.io"]
+	}
+	return host
+}
+
+// authenticator returns an authenticator presenting the configured
+// credentials.
+func (a *registryAuth) authenticator() authn.Authenticator {
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      a.Username,
+		Password:      a.Password,
+		Auth:          a.Auth,
+		IdentityToken: a.IdentityToken,
+	})
+}
+
+// tlsConfig returns the client TLS configuration for a registry with these
+// settings. The CA file is trusted in addition to the system roots.
+func (t *registryTLS) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// loadRegistryConfig reads the private registry configuration at path. A
+// missing file, or an empty path, results in an empty configuration.
+func loadRegistryConfig(path string) (*registryConfig, error) {
+	config := &registryConfig{}
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// mirrorReferences returns ref rewritten to each of the mirror endpoints
+// configured for its registry.
+func mirrorReferences(ref name.Reference, config *registryConfig) []name.Reference {
+	registry := ref.Context().RegistryStr()
+	mirror, ok := config.Mirrors[registry]
+	if !ok && registry == name.DefaultRegistry {
+		mirror, ok = config.Mirrors["docker.io"]
+	}
+	if !ok {
+		return nil
+	}
+
+	var refs []name.Reference
+	for _, endpoint := range mirror.Endpoints {
+		host, opts := endpointHost(endpoint)
+		if host == "" || host == registry {
+			continue
+		}
+		mirrorRef, err := name.ParseReference(host+"/"+ref.Context().RepositoryStr()+identifierSuffix(ref), opts...)
+		if err != nil {
+			continue
+		}
+		refs = append(refs, mirrorRef)
+	}
+	return refs
+}
+
+// endpointHost returns the registry host of a mirror endpoint URL, along
+// with the options needed to parse references against it.
+func endpointHost(endpoint string) (string, []name.Option) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", nil
+	}
+	if u.Scheme == "http" {
+		return u.Host, []name.Option{name.Insecure}
+	}
+	return u.Host, nil
+}
+
+// identifierSuffix returns the tag or digest part of ref, including its
+// separator.
+func identifierSuffix(ref name.Reference) string {
+	if _, ok := ref.(name.Digest); ok {
+		return "@" + ref.Identifier()
+	}
+	return ":" + ref.Identifier()
+}
@@ -0,0 +1,72 @@
+package bootstrap
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestValidatePrivateRegistries(t *testing.T) {
+	dir := tempDir(t)
+	notPEM := filepath.Join(dir, "ca.pem")
+	writeFile(t, notPEM, "not a certificate", 0644)
+
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"empty", "", true},
+		{"mirror", `
+mirrors:
+  docker.io:
+    endpoint: ["https://mirror.example", "http://mirror.example:5000"]
+configs:
+  mirror.example:
+    auth:
+      username: user
+      password: pass
+`, true},
+		{"unparseable", "mirrors: [", false},
+		{"bad endpoint", `
+mirrors:
+  docker.io:
+    endpoint: ["https://%zz"]
+`, false},
+		{"incomplete auth", `
+configs:
+  mirror.example:
+    auth:
+      username: user
+`, false},
+		{"missing ca", `
+configs:
+  mirror.example:
+    tls:
+      ca_file: ` + filepath.Join(dir, "missing.pem") + `
+`, false},
+		{"invalid ca", `
+configs:
+  mirror.example:
+    tls:
+      ca_file: ` + notPEM + `
+`, false},
+		{"unpaired cert", `
+configs:
+  mirror.example:
+    tls:
+      cert_file: ` + notPEM + `
+`, false},
+	}
+	for _, tt := range tests {
+		err := ValidatePrivateRegistries(writeRegistries(t, tt.config))
+		if tt.valid && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.valid && err == nil {
+			t.Errorf("%s: invalid configuration passed", tt.name)
+		}
+	}
+
+	if err := ValidatePrivateRegistries(filepath.Join(dir, "missing.yaml")); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+}
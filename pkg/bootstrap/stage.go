@@ -2,21 +2,27 @@ package bootstrap
 
 import (
 	"archive/tar"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/mutate"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
 	"github.com/rancher/rke2/pkg/images"
+	"github.com/rancher/wrangler/pkg/merr"
 	"github.com/sirupsen/logrus"
 )
 
@@ -43,92 +49,1076 @@ func dirExists(dir string) bool {
 	return false
 }
 
-func Stage(dataDir string, images images.Images) (string, error) {
-	ref, err := name.ParseReference(images.Runtime)
+// StageOptions controls optional behavior of Stage.
+type StageOptions struct {
+	// ValidateBinaries checks that the key runtime binaries are valid
+	// executables before the bin dir symlink is updated.
+	ValidateBinaries bool
+	// BinDirMode is the mode applied to the bin dir. It also masks the modes
+	// of the files extracted into it, so that by default they are not group
+	// or world writable. Defaults to 0755.
+	BinDirMode os.FileMode
+	// ExtraExtractPaths maps additional top-level image directories to the
+	// directories they should be extracted to, alongside bin and charts.
+	ExtraExtractPaths map[string]string
+	// Metrics, if set, is filled in with timings and counters for the run.
+	Metrics *StageMetrics
+	// Image, if set, is used as the runtime image instead of pulling it. The
+	// data dir name is still derived from the runtime image reference.
+	Image v1.Image
+	// PrivateRegistry is the path to the private registry configuration.
+	// Its mirrors are tried when the runtime image cannot be pulled, and the
+	// credentials and TLS settings it configures for a registry are used
+	// for all requests to that registry.
+	PrivateRegistry string
+	// Transport, if set, is used for all registry requests instead of the
+	// default proxy-aware transport, and the TLS settings in the private
+	// registry configuration are ignored.
+	Transport http.RoundTripper
+	// FailOnRealBinDir makes Stage return an error, rather than warn and
+	// remove it, when the data dir bin path is a directory instead of a
+	// symlink.
+	FailOnRealBinDir bool
+	// LockTimeout is how long to wait for another Stage call on the same
+	// data dir to finish. Defaults to 5 minutes.
+	LockTimeout time.Duration
+	// Logger, if set, is used for all log messages so that callers can
+	// attach fields identifying the node or boot. Defaults to the standard
+	// logger.
+	Logger *logrus.Entry
+	// FailOnPlatformMismatch makes Stage return an error, rather than log a
+	// warning, when the runtime image was built for a different OS or
+	// architecture.
+	FailOnPlatformMismatch bool
+	// ExtraKeychains are consulted, in order, before the default keychain
+	// when authenticating registry requests.
+	ExtraKeychains []authn.Keychain
+	// ReleasePattern matches the runtime image tags that identify a
+	// release, whose staged runtime can be reused without pulling the image.
+	// Defaults to tags starting with v and a digit.
+	ReleasePattern *regexp.Regexp
+	// TolerateFileErrors makes extraction carry on past files that cannot
+	// be created, reporting all such failures together once the image has
+	// been read. Errors reading the image itself still abort immediately.
+	TolerateFileErrors bool
+	// SkipUnchanged leaves files that already exist in the destination
+	// directories alone when their mode and contents match the image,
+	// rather than replacing them. Entries are compared with the existing
+	// files as they are read, so unchanged files are not written at all.
+	// A new bin dir is compared with the active one instead, and its
+	// unchanged binaries are hardlinked to the active runtime's, so
+	// upgrades only write the binaries that changed. As with
+	// HardlinkDuplicates, the linked files are shared between runtimes.
+	SkipUnchanged bool
+	// FallbackToDefaultRegistry makes Stage try the runtime image from the
+	// default public reference when it cannot be pulled from the configured
+	// one or its mirrors. It is off by default so that air-gapped nodes
+	// never reach out to the public registry.
+	FallbackToDefaultRegistry bool
+	// MaxEntries and MaxBytes limit the number of tar entries read from, and
+	// the number of bytes written for, the runtime image as a whole, across
+	// all of its layers. They default to 100000 entries and 8GiB.
+	MaxEntries int
+	MaxBytes   int64
+	// MaxFileSize limits the size of any single extracted file. Defaults to
+	// 4GiB.
+	MaxFileSize int64
+	// TempDir is where the runtime image is extracted before being moved
+	// into the data dir. It must be on the same filesystem as the data dir;
+	// if it is not, the data dir is used instead. Defaults to the data dir.
+	TempDir string
+	// InsecureSkipTLSVerify disables verification of registry certificates
+	// when pulling the runtime image. It is ignored if Transport is set.
+	InsecureSkipTLSVerify bool
+	// FallbackToStaged makes Stage use the most recently staged runtime,
+	// if its binaries are still valid, when the runtime image cannot be
+	// pulled. This keeps a node running through a registry outage, at the
+	// cost of possibly running an older runtime.
+	FallbackToStaged bool
+	// LogProgress logs each runtime image layer as it is read at Info,
+	// rather than Debug, level so that slow pulls are visibly progressing.
+	LogProgress bool
+	// ManifestsDir is where the charts in the runtime image are extracted
+	// to. Defaults to server/manifests in the data dir.
+	ManifestsDir string
+	// Offline guarantees that no registry is contacted. Unless the runtime
+	// is already staged or provided in Image, Stage fails instead of
+	// pulling it.
+	Offline bool
+	// HardlinkDuplicates replaces files in a newly extracted bin dir with
+	// hardlinks to identical files in other staged runtimes, to save disk
+	// space. Linked files are shared, so pruning a runtime must not modify
+	// them in place.
+	HardlinkDuplicates bool
+	// AllowedRegistries, if not empty, are the only registry hosts the
+	// runtime image may be pulled from, including mirrors.
+	AllowedRegistries []string
+	// Overwrite controls what happens to existing files in the
+	// destination directories, such as the manifests dir. Defaults to
+	// replacing them.
+	Overwrite OverwritePolicy
+	// HeaderHook, if set, is called with each tar entry read from the
+	// runtime image before it is extracted. It can return a rewritten
+	// header, false to skip the entry, or an error to abort staging. It
+	// may be called concurrently, and more than once for the same entry.
+	HeaderHook func(h *tar.Header) (*tar.Header, bool, error)
+	// LocalSource, if set, is asked for the runtime image before it is
+	// pulled, for example to load it from a local containerd or docker
+	// image store. It returns a nil image if it does not have the image.
+	LocalSource func(ref name.Reference) (v1.Image, error)
+	// ManifestsFileMode and ManifestsDirMode, if set, are the modes given to
+	// the charts extracted into the manifests dir and to the manifests dir
+	// itself, instead of the modes in the image.
+	ManifestsFileMode os.FileMode
+	ManifestsDirMode  os.FileMode
+	// CopyBinaries makes the data dir bin path a real directory holding
+	// hardlinks to, or copies of, the staged binaries instead of a symlink,
+	// for platforms where symlinks are unsupported.
+	CopyBinaries bool
+	// Owner, if set, is the owner given to everything Stage writes: the
+	// extracted files and links, the directories they are extracted into,
+	// the stage info and the data dir bin link or copy, for example when
+	// running rootless. By default they are owned by the current process.
+	// Not supported on Windows.
+	Owner *FileOwner
+}
+
+// FileOwner is the numeric owner of extracted files.
+type FileOwner struct {
+	UID int
+	GID int
+}
+
+// ImageSource identifies where the runtime image was obtained from.
+type ImageSource string
+
+const (
+	// ImageSourceRemote is an image pulled from a registry.
+	ImageSourceRemote ImageSource = "remote"
+	// ImageSourceProvided is an image passed in through StageOptions.Image.
+	ImageSourceProvided ImageSource = "provided"
+	// ImageSourceLocal is an image loaded through StageOptions.LocalSource.
+	ImageSourceLocal ImageSource = "local"
+	// ImageSourceStaged is a runtime that was already staged in the data
+	// dir, so no image was needed.
+	ImageSourceStaged ImageSource = "staged"
+)
+
+// OverwritePolicy is how Stage handles files that already exist where it
+// extracts the runtime image to.
+type OverwritePolicy string
+
+const (
+	// OverwriteReplace replaces existing files.
+	OverwriteReplace OverwritePolicy = ""
+	// OverwriteSkip keeps existing files, logging each one skipped.
+	OverwriteSkip OverwritePolicy = "skip"
+	// OverwriteFail fails staging if a file already exists.
+	OverwriteFail OverwritePolicy = "fail"
+)
+
+// StageResult describes the outcome of StageWithResult.
+type StageResult struct {
+	// BinDir is the directory holding the runtime binaries.
+	BinDir string
+	// Source is where the runtime image was obtained from.
+	Source ImageSource
+	// Extracted is true if anything was extracted from the image, rather
+	// than reusing a previously staged runtime.
+	Extracted bool
+}
+
+// StageMetrics records how long the phases of Stage took and how much data
+// they handled.
+type StageMetrics struct {
+	// Source is where the runtime image was obtained from.
+	Source ImageSource
+	// ResolveDuration is how long it took to resolve the runtime image in
+	// its registry. Only the image manifest is fetched at that point; the
+	// layers are downloaded while they are extracted, so their download
+	// time is part of ExtractDuration. It is zero if the image was not
+	// pulled.
+	ResolveDuration time.Duration
+	// ExtractDuration is how long it took to read the runtime image layers,
+	// extract them and move the results into place.
+	ExtractDuration time.Duration
+	FilesExtracted  int
+	BytesExtracted  int64
+}
+
+// extractStats counts what was written during an extraction.
+type extractStats struct {
+	// Files counts regular files and hardlinks, Symlinks the symlinks
+	// created.
+	Files    int
+	Dirs     int
+	Symlinks int
+	Bytes    int64
+
+	// found holds the top-level directories the image contained.
+	found map[string]bool
+	// whiteouts are the paths of the whiteout markers encountered, in
+	// order.
+	whiteouts []string
+	// paths maps each file written, relative to the target dir, to the path
+	// of the entry it was extracted from.
+	paths map[string]string
+	// unchanged holds the files, relative to the target dir, that were not
+	// written because they are identical to the existing destination file.
+	unchanged map[string]bool
+}
+
+func newExtractStats() extractStats {
+	return extractStats{
+		found:     map[string]bool{},
+		paths:     map[string]string{},
+		unchanged: map[string]bool{},
+	}
+}
+
+func (s *extractStats) add(other extractStats) {
+	s.Files += other.Files
+	s.Dirs += other.Dirs
+	s.Symlinks += other.Symlinks
+	s.Bytes += other.Bytes
+	for src := range other.found {
+		s.found[src] = true
+	}
+}
+
+func (o StageOptions) logger() *logrus.Entry {
+	if o.Logger == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return o.Logger
+}
+
+// extractOptions controls how extract writes the entries it extracts.
+type extractOptions struct {
+	// dirs are the top-level image directories to extract.
+	dirs map[string]extractDir
+	log  *logrus.Entry
+	// tolerateFileErrors collects errors creating individual files instead
+	// of aborting on the first one.
+	tolerateFileErrors bool
+	// limits aborts extraction of images that are larger than any
+	// legitimate runtime image. It is shared by the layers of an image.
+	limits      *extractLimits
+	maxFileSize int64
+	owner       *FileOwner
+	// progress logs each layer as it is read.
+	progress func(format string, args ...interface{})
+	hook     func(h *tar.Header) (*tar.Header, bool, error)
+}
+
+// extractLimits counts the entries and bytes read from an image, which may be
+// extracted from several layers at once.
+type extractLimits struct {
+	mu         sync.Mutex
+	entries    int
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+}
+
+// addEntry counts an entry and reports whether the image is still within
+// maxEntries.
+func (l *extractLimits) addEntry() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries++
+	return l.entries <= l.maxEntries
+}
+
+// addBytes counts n bytes and reports whether the image is still within
+// maxBytes.
+func (l *extractLimits) addBytes(n int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytes += n
+	return l.bytes <= l.maxBytes
+}
+
+// extractDir controls how the files under one top-level image directory
+// are written.
+type extractDir struct {
+	// perm masks the permission bits of extracted files.
+	perm os.FileMode
+	// mode, if set, is used for all extracted files instead of the mode in
+	// the image.
+	mode os.FileMode
+	// compare, if set, is the destination directory whose files are
+	// compared with the entries, so that identical files are not written.
+	compare string
+	// linkUnchanged is set when compare is not the destination, but a
+	// previous version of it. Unchanged files are then linked from there
+	// rather than left in place.
+	linkUnchanged bool
+}
+
+// extractOptions returns the options for extracting the top-level image
+// directories named by the keys of dirs. previous maps top-level
+// directories to a previous version of their destination, which entries are
+// compared with instead of the destination itself.
+func (o StageOptions) extractOptions(dirs, previous map[string]string) extractOptions {
+	ex := make(map[string]extractDir, len(dirs))
+	for src, dest := range dirs {
+		dir := extractDir{perm: os.ModePerm}
+		if o.SkipUnchanged {
+			dir.compare = dest
+			if prev, ok := previous[src]; ok {
+				dir.compare = prev
+				dir.linkUnchanged = true
+			}
+		}
+		if src == "bin" {
+			dir.perm = o.binDirMode()
+		} else if src == "charts" {
+			dir.mode = o.ManifestsFileMode
+		}
+		ex[src] = dir
+	}
+	return extractOptions{
+		dirs:               ex,
+		log:                o.logger(),
+		tolerateFileErrors: o.TolerateFileErrors,
+		limits:             &extractLimits{maxEntries: o.maxEntries(), maxBytes: o.maxBytes()},
+		maxFileSize:        o.maxFileSize(),
+		owner:              o.Owner,
+		progress:           o.progressLogger(),
+		hook:               o.HeaderHook,
+	}
+}
+
+// tempBase returns the directory extraction temp dirs are created in.
+func (o StageOptions) tempBase(dataDir string) string {
+	if o.TempDir == "" {
+		return dataDir
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return dataDir
+	}
+	if err := os.MkdirAll(o.TempDir, 0755); err != nil {
+		o.logger().Warnf("Failed to create temp dir %s, using %s: %v", o.TempDir, dataDir, err)
+		return dataDir
+	}
+	same, err := sameDevice(o.TempDir, dataDir)
 	if err != nil {
-		return "", err
+		o.logger().Warnf("Failed to check temp dir %s, using %s: %v", o.TempDir, dataDir, err)
+		return dataDir
+	}
+	if !same {
+		o.logger().Warnf("Temp dir %s is not on the same filesystem as %s, using %s", o.TempDir, dataDir, dataDir)
+		return dataDir
+	}
+	return o.TempDir
+}
+
+func (o StageOptions) progressLogger() func(string, ...interface{}) {
+	if o.LogProgress {
+		return o.logger().Infof
+	}
+	return o.logger().Debugf
+}
+
+func (o StageOptions) manifestsDir(dataDir string) string {
+	if o.ManifestsDir == "" {
+		return manifestsDir(dataDir)
+	}
+	return o.ManifestsDir
+}
+
+func (o StageOptions) maxEntries() int {
+	if o.MaxEntries == 0 {
+		return 100000
+	}
+	return o.MaxEntries
+}
+
+func (o StageOptions) maxBytes() int64 {
+	if o.MaxBytes == 0 {
+		return 8 << 30
+	}
+	return o.MaxBytes
+}
+
+func (o StageOptions) maxFileSize() int64 {
+	if o.MaxFileSize == 0 {
+		return 4 << 30
 	}
-	// downloading the image
-	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	return o.MaxFileSize
+}
+
+func (o StageOptions) releasePattern() *regexp.Regexp {
+	if o.ReleasePattern == nil {
+		return releasePattern
+	}
+	return o.ReleasePattern
+}
+
+func (o StageOptions) lockTimeout() time.Duration {
+	if o.LockTimeout == 0 {
+		return 5 * time.Minute
+	}
+	return o.LockTimeout
+}
+
+func (o StageOptions) binDirMode() os.FileMode {
+	if o.BinDirMode == 0 {
+		return 0755
+	}
+	return o.BinDirMode
+}
+
+// Stage extracts the runtime image into dataDir and returns the bin dir
+// holding its binaries.
+func Stage(dataDir string, images images.Images, opts StageOptions) (string, error) {
+	result, err := StageWithResult(dataDir, images, opts)
 	if err != nil {
 		return "", err
 	}
+	return result.BinDir, nil
+}
+
+// StageWithResult is like Stage, but reports what it did in a StageResult.
+func StageWithResult(dataDir string, images images.Images, opts StageOptions) (*StageResult, error) {
+	metrics := opts.Metrics
+	if metrics == nil {
+		metrics = &StageMetrics{}
+	}
+
+	ref, dataName, err := EffectiveRuntimeReference(images, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockDataDir(dataDir, opts.lockTimeout())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	dataName := releaseName(ref)
+	// a runtime that has already been staged is reused without touching
+	// the registry, as long as its binaries are intact and the charts were
+	// placed; if the charts are missing they are extracted again below
 	if dataName != "" {
-		if dir := dataDirFor(dataDir, dataName); dirExists(dir) {
-			return dir, nil
+		binDir := dataDirFor(dataDir, dataName)
+		if dirExists(binDir) && opts.ValidateBinaries {
+			if err := validateBinaries(binDir); err != nil {
+				opts.logger().Warnf("Staged runtime in %s is incomplete, staging it again: %v", binDir, err)
+				if err := os.RemoveAll(binDir); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if dirExists(binDir) && dirExists(opts.manifestsDir(dataDir)) {
+			if staged, err := IsStaged(dataDir, images, opts); err != nil || !staged {
+				if err := linkBinDir(dataDir, binDir, opts); err != nil {
+					return nil, err
+				}
+			}
+			metrics.Source = ImageSourceStaged
+			opts.logger().Infof("Using runtime image %s already staged in %s", images.Runtime, binDir)
+			return &StageResult{
+				BinDir: binDir,
+				Source: ImageSourceStaged,
+			}, nil
+		}
+	}
+
+	start := time.Now()
+	img := opts.Image
+	if img != nil {
+		metrics.Source = ImageSourceProvided
+		opts.logger().Infof("Using provided runtime image for %s", images.Runtime)
+	} else if img = loadLocal(ref, opts); img != nil {
+		metrics.Source = ImageSourceLocal
+		opts.logger().Infof("Loaded runtime image %s from local source", ref)
+	} else {
+		// downloading the image
+		img, err = pullImage(ref, opts)
+		if err != nil {
+			err = &PullError{Image: ref.String(), Err: err}
+			if opts.FallbackToStaged {
+				if result := fallbackToStaged(dataDir, err, opts); result != nil {
+					metrics.Source = ImageSourceStaged
+					return result, nil
+				}
+			}
+			return nil, err
 		}
+		metrics.Source = ImageSourceRemote
+		metrics.ResolveDuration = time.Since(start)
+		opts.logger().Infof("Resolved runtime image %s in registry", ref)
 	}
+
 	if dataName == "" {
 		digest, err := img.Digest()
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		dataName = digest.Hex
 	}
 
 	binDir := dataDirFor(dataDir, dataName)
-	if err := extractFromDir(binDir, "/bin/", img, images.Runtime); err != nil {
-		return "", err
+	extractPaths := map[string]string{
+		"charts": opts.manifestsDir(dataDir),
+	}
+	for src, dest := range opts.ExtraExtractPaths {
+		extractPaths[src] = dest
+	}
+	previous := map[string]string{}
+	if !dirExists(binDir) {
+		extractPaths["bin"] = binDir
+		if opts.SkipUnchanged {
+			if active, err := ResolveActiveBinDir(dataDir); err == nil && active != "" && dirExists(active) {
+				previous["bin"] = active
+			}
+		}
 	}
 
-	manifestDir := manifestsDir(dataDir)
-	err = extractFromDir(manifestDir, "/charts/", img, images.Runtime)
+	if err := checkPlatform(img, opts); err != nil {
+		return nil, err
+	}
+	if err := checkWritable(opts.manifestsDir(dataDir)); err != nil {
+		return nil, errors.Wrap(err, "manifests dir is not writable")
+	}
 
-	// ignore errors
-	_ = os.RemoveAll(symlinkBinDir(dataDir))
-	_ = os.Symlink(binDir, symlinkBinDir(dataDir))
+	start = time.Now()
+	stats, err := extractToDirs(img, images.Runtime, opts.tempBase(dataDir), extractPaths, previous, opts)
+	metrics.ExtractDuration = time.Since(start)
+	metrics.FilesExtracted = stats.Files
+	metrics.BytesExtracted = stats.Bytes
+	if err != nil {
+		// a partially staged bin dir would otherwise be reused next time
+		if _, ok := extractPaths["bin"]; ok {
+			_ = os.RemoveAll(binDir)
+		}
+		if verr, ok := err.(*ValidationError); ok {
+			return nil, verr
+		}
+		return nil, &ExtractError{Image: images.Runtime, DataDir: dataDir, Err: err}
+	}
+	opts.logger().Infof("Extracted %d files, %d directories, %d symlinks, %d bytes from %s in %s",
+		stats.Files, stats.Dirs, stats.Symlinks, stats.Bytes, images.Runtime, metrics.ExtractDuration)
+	if err := os.Chmod(binDir, opts.binDirMode()); err != nil {
+		return nil, err
+	}
+	if opts.ManifestsDirMode != 0 {
+		if err := os.Chmod(opts.manifestsDir(dataDir), opts.ManifestsDirMode); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := extractPaths["bin"]; ok && opts.HardlinkDuplicates {
+		if err := dedupBinDir(dataDir, binDir, opts); err != nil {
+			opts.logger().Warnf("Failed to hardlink duplicate files in %s: %v", binDir, err)
+		}
+	}
+	if _, ok := extractPaths["bin"]; ok {
+		digest, err := img.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeStageInfo(dataDir, dataName, StageInfo{
+			Image:    images.Runtime,
+			Digest:   digest.String(),
+			StagedAt: time.Now(),
+			Files:    stats.Files,
+			Bytes:    stats.Bytes,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Owner != nil {
+		owned := []string{filepath.Dir(binDir), binDir}
+		if _, ok := extractPaths["bin"]; ok {
+			owned = append(owned, stageInfoFile(dataDir, dataName))
+		}
+		for _, name := range owned {
+			if err := lchown(name, opts.Owner); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := linkBinDir(dataDir, binDir, opts); err != nil {
+		return nil, err
+	}
 
-	return binDir, err
+	return &StageResult{
+		BinDir:    binDir,
+		Source:    metrics.Source,
+		Extracted: true,
+	}, nil
 }
 
-func extract(image, targetDir, prefix string, reader io.Reader) error {
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return err
+// linkBinDir makes binDir the active runtime bin dir. The data dir bin symlink
+// is atomically pointed at binDir or, if opts.CopyBinaries is set, binDir is
+// copied into a real data dir bin directory and recorded as active. binDir is
+// also recorded if the symlink cannot be created; otherwise any stale record
+// is removed.
+func linkBinDir(dataDir, binDir string, opts StageOptions) error {
+	link := symlinkBinDir(dataDir)
+	if opts.CopyBinaries {
+		if err := copyBinDir(binDir, link); err != nil {
+			return errors.Wrapf(err, "failed to copy %s to %s", binDir, link)
+		}
+		if err := chownDir(link, opts.Owner); err != nil {
+			return err
+		}
+		return writeActivePointer(dataDir, binDir, opts.Owner)
 	}
 
+	if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		if opts.FailOnRealBinDir {
+			return fmt.Errorf("%s is not a symlink, refusing to replace it", link)
+		}
+		opts.logger().Warnf("%s is not a symlink, removing it and all of its contents", link)
+		// a directory cannot be renamed over, so it has to go first
+		if err := os.RemoveAll(link); err != nil {
+			opts.logger().Warnf("Failed to remove %s: %v", link, err)
+		}
+	}
+
+	if err := swapLink(link, binDir); err != nil {
+		// fall back to recording the bin dir in the data dir when the bin
+		// symlink cannot be created, for example on a read-only mount
+		if perr := writeActivePointer(dataDir, binDir, opts.Owner); perr != nil {
+			return err
+		}
+		opts.logger().Warnf("Failed to link %s to %s, recorded it in %s instead: %v", link, binDir, activePointerFile(dataDir), err)
+		return nil
+	}
+	if opts.Owner != nil {
+		if err := lchown(link, opts.Owner); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(activePointerFile(dataDir)); err != nil && !os.IsNotExist(err) {
+		opts.logger().Warnf("Failed to remove %s: %v", activePointerFile(dataDir), err)
+	}
+	return nil
+}
+
+// loadLocal returns ref from opts.LocalSource, or nil if there is no local
+// source or it does not have the image.
+func loadLocal(ref name.Reference, opts StageOptions) v1.Image {
+	if opts.LocalSource == nil {
+		return nil
+	}
+	img, err := opts.LocalSource(ref)
+	if err != nil {
+		opts.logger().Warnf("Failed to load runtime image %s from local source: %v", ref, err)
+		return nil
+	}
+	return img
+}
+
+// fallbackToStaged links the bin dir of the most recently staged runtime
+// after the runtime image failed to pull with err. It returns nil if there
+// is no usable staged runtime.
+func fallbackToStaged(dataDir string, err error, opts StageOptions) *StageResult {
+	dataName, lerr := latestStaged(dataDir)
+	if lerr != nil || dataName == "" {
+		return nil
+	}
+	binDir := dataDirFor(dataDir, dataName)
+	if verr := validateBinaries(binDir); verr != nil {
+		opts.logger().Warnf("Not falling back to staged runtime %s: %v", binDir, verr)
+		return nil
+	}
+	if lerr := linkBinDir(dataDir, binDir, opts); lerr != nil {
+		opts.logger().Warnf("Not falling back to staged runtime %s: %v", binDir, lerr)
+		return nil
+	}
+
+	opts.logger().Warnf("Falling back to previously staged runtime %s, which may not match the configured version: %v", binDir, err)
+	return &StageResult{
+		BinDir: binDir,
+		Source: ImageSourceStaged,
+	}
+}
+
+// EffectiveRuntimeReference returns the runtime image reference Stage would
+// pull, along with the name of the data dir it would be staged into. The
+// name is empty for non-release tags, which are only named by their digest
+// once pulled. Nothing is read from disk or the registry.
+func EffectiveRuntimeReference(images images.Images, opts StageOptions) (name.Reference, string, error) {
+	ref, err := name.ParseReference(images.Runtime)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "invalid runtime image %s", images.Runtime)
+	}
+	return ref, releaseName(ref, opts.releasePattern()), nil
+}
+
+// IsStaged reports whether the runtime image has already been extracted
+// into dataDir and the bin symlink points at it. Runtime images referenced
+// by a non-release tag can only be identified after pulling them, so they
+// are never reported as staged.
+func IsStaged(dataDir string, images images.Images, opts StageOptions) (bool, error) {
+	_, dataName, err := EffectiveRuntimeReference(images, opts)
+	if err != nil {
+		return false, err
+	}
+	if dataName == "" {
+		return false, nil
+	}
+
+	binDir := dataDirFor(dataDir, dataName)
+	if !dirExists(binDir) {
+		return false, nil
+	}
+
+	active, err := ResolveActiveBinDir(dataDir)
+	if err != nil {
+		return false, err
+	}
+	return active == binDir, nil
+}
+
+// extract writes the files under each top-level directory in opts.dirs from
+// the tar stream in reader to the directory of the same name in targetDir.
+// Whiteout markers are only recorded, for mergeLayer to apply to the files of
+// earlier layers.
+func extract(image, targetDir string, reader io.Reader, opts extractOptions) (extractStats, error) {
+	stats := newExtractStats()
+	for src := range opts.dirs {
+		if err := os.MkdirAll(filepath.Join(targetDir, src), 0755); err != nil {
+			return stats, err
+		}
+	}
+
+	var fileErrs []error
+
 	t := tar.NewReader(reader)
 	for {
 		h, err := t.Next()
 		if err == io.EOF {
-			logrus.Infof("Extracting %s done", image)
-			return nil
+			if len(fileErrs) > 0 {
+				opts.log.Warnf("Extracting %s done, %d files failed", image, len(fileErrs))
+				return stats, merr.NewErrors(fileErrs...)
+			}
+			opts.log.Infof("Extracting %s done", image)
+			return stats, nil
 		} else if err != nil {
-			return err
+			return stats, err
+		}
+
+		if !opts.limits.addEntry() {
+			return stats, fmt.Errorf("image %s has more than %d entries", image, opts.limits.maxEntries)
+		}
+
+		if opts.hook != nil {
+			var keep bool
+			h, keep, err = opts.hook(h)
+			if err != nil {
+				return stats, err
+			}
+			if !keep || h == nil {
+				continue
+			}
+		}
+
+		n := entryPath(h.Name)
+		src := topDir(n)
+		// whiteouts of a whole top-level directory sit beside it rather
+		// than in it
+		if name := strings.TrimPrefix(src, whiteoutPrefix); n == "/"+src && name != src {
+			if _, ok := opts.dirs[name]; ok || src == whiteoutOpaque {
+				stats.whiteouts = append(stats.whiteouts, n)
+				continue
+			}
+		}
+		dir, ok := opts.dirs[src]
+		if !ok {
+			continue
+		}
+		stats.found[src] = true
+		if n == "/"+src {
+			continue
 		}
 
 		if h.FileInfo().IsDir() {
+			stats.Dirs++
 			continue
 		}
 
-		n := filepath.Join("/", h.Name)
-		if !strings.HasPrefix(n, prefix) {
+		base := path.Base(n)
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			stats.whiteouts = append(stats.whiteouts, n)
 			continue
 		}
 
-		targetName := filepath.Join(targetDir, filepath.Base(n))
-		mode := h.FileInfo().Mode() & 0755
+		if h.Size > opts.maxFileSize {
+			return stats, fmt.Errorf("image %s file %s is %d bytes, more than the %d allowed", image, h.Name, h.Size, opts.maxFileSize)
+		}
+		if !opts.limits.addBytes(h.Size) {
+			return stats, fmt.Errorf("image %s has more than %d bytes to extract", image, opts.limits.maxBytes)
+		}
+
+		file := filepath.Join(src, base)
+		targetName := filepath.Join(targetDir, file)
+		_, overwrite := stats.paths[file]
+		if overwrite {
+			opts.log.Infof("Extracting %s %s overwrites an earlier entry", image, h.Name)
+		}
+		mode := fileMode(h, dir.perm)
+		if dir.mode != 0 {
+			mode = dir.mode
+		}
+
+		if h.Typeflag == tar.TypeSymlink || h.Typeflag == tar.TypeLink {
+			if overwrite {
+				os.Remove(targetName)
+			}
+			if err := extractLink(targetDir, targetName, n, h, stats, opts); err != nil {
+				delete(stats.paths, file)
+				if opts.tolerateFileErrors {
+					fileErrs = append(fileErrs, err)
+					continue
+				}
+				return stats, err
+			}
+			opts.log.Infof("Extracting %s %s...", image, h.Name)
+			delete(stats.unchanged, file)
+			stats.paths[file] = n
+			if h.Typeflag == tar.TypeSymlink {
+				stats.Symlinks++
+			} else {
+				stats.Files++
+			}
+			continue
+		}
+		if !h.FileInfo().Mode().IsRegular() {
+			opts.log.Debugf("Extracting %s %s skipped, not a regular file", image, h.Name)
+			continue
+		}
+
+		entry := &partialEntry{}
+		if dir.compare != "" {
+			entry, err = compareEntry(filepath.Join(dir.compare, base), mode, h.Size, t)
+			if err != nil {
+				return stats, err
+			}
+			if entry == nil && dir.linkUnchanged {
+				if overwrite {
+					os.Remove(targetName)
+				}
+				if err := linkOrCopy(filepath.Join(dir.compare, base), targetName); err != nil {
+					delete(stats.paths, file)
+					if opts.tolerateFileErrors {
+						fileErrs = append(fileErrs, err)
+						continue
+					}
+					return stats, err
+				}
+				opts.log.Debugf("Extracting %s %s linked, unchanged", image, h.Name)
+				delete(stats.unchanged, file)
+				stats.paths[file] = n
+				stats.Files++
+				continue
+			}
+			if entry == nil {
+				opts.log.Debugf("Extracting %s %s skipped, unchanged", image, h.Name)
+				if overwrite {
+					if err := os.Remove(targetName); err != nil {
+						return stats, err
+					}
+					delete(stats.paths, file)
+				}
+				stats.unchanged[file] = true
+				continue
+			}
+		}
+		delete(stats.unchanged, file)
+		stats.paths[file] = n
+		if overwrite {
+			// the earlier entry may be hardlinked to, so replace it rather
+			// than truncating it
+			os.Remove(targetName)
+		}
 		f, err := os.OpenFile(targetName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
 		if err != nil {
-			return nil
+			if opts.tolerateFileErrors {
+				fileErrs = append(fileErrs, err)
+				continue
+			}
+			return stats, err
 		}
-		logrus.Infof("Extracting %s %s...", image, h.Name)
-		if _, err = io.Copy(f, t); err != nil {
+		// the mode passed to OpenFile is subject to umask and ignored for
+		// existing files, so set it explicitly
+		if err := f.Chmod(mode); err != nil {
 			f.Close()
-			return err
+			if opts.tolerateFileErrors {
+				fileErrs = append(fileErrs, errors.Wrapf(err, "setting mode of %s", targetName))
+				continue
+			}
+			return stats, err
+		}
+		if opts.owner != nil {
+			if err := chown(f, opts.owner); err != nil {
+				f.Close()
+				if opts.tolerateFileErrors {
+					fileErrs = append(fileErrs, errors.Wrapf(err, "setting owner of %s", targetName))
+					continue
+				}
+				return stats, err
+			}
+		}
+		opts.log.Infof("Extracting %s %s...", image, h.Name)
+		written, err := copyEntry(f, entry, t)
+		if err != nil {
+			// don't leave a truncated file behind for a later run to find
+			f.Close()
+			os.Remove(targetName)
+			return stats, err
 		}
 		if err := f.Close(); err != nil {
-			return err
+			return stats, err
+		}
+		stats.Files++
+		stats.Bytes += written
+	}
+}
+
+// extractLink creates the symlink or hardlink h, read from the entry path n,
+// as targetName. Files are extracted without their subdirectories, so
+// symlinks to files in the same top-level directory are pointed at the
+// file's base name, and hardlinks are made to the file extracted for the
+// entry they link to.
+func extractLink(targetDir, targetName, n string, h *tar.Header, stats extractStats, opts extractOptions) error {
+	if h.Typeflag == tar.TypeSymlink {
+		target := h.Linkname
+		resolved := entryPath(target)
+		if !path.IsAbs(target) {
+			resolved = entryPath(path.Join(path.Dir(n), target))
+		}
+		if topDir(resolved) == topDir(n) && resolved != "/"+topDir(n) {
+			target = path.Base(resolved)
+		}
+		return errors.Wrapf(os.Symlink(target, targetName), "creating symlink %s", targetName)
+	}
+
+	linked := entryPath(h.Linkname)
+	src := topDir(linked)
+	dir, ok := opts.dirs[src]
+	if !ok || linked == "/"+src {
+		return fmt.Errorf("hardlink %s to %s is outside the extracted directories", h.Name, h.Linkname)
+	}
+	file := filepath.Join(src, path.Base(linked))
+	oldName := filepath.Join(targetDir, file)
+	if stats.unchanged[file] {
+		// the file was not written, as it is already in place
+		oldName = filepath.Join(dir.compare, path.Base(linked))
+	}
+	return errors.Wrapf(os.Link(oldName, targetName), "creating hardlink %s", targetName)
+}
+
+// topDir returns the top-level directory of an entry path.
+func topDir(n string) string {
+	return strings.SplitN(strings.TrimPrefix(n, "/"), "/", 2)[0]
+}
+
+// partialEntry is a tar entry whose contents were partly read while comparing
+// them with an existing file. The first matched bytes are the same as those of
+// the existing file, and pending holds the bytes read after them.
+type partialEntry struct {
+	existing string
+	matched  int64
+	pending  []byte
+}
+
+// compareEntry reads the contents of a tar entry of the given mode and size
+// from r for as long as they match the file name. It returns nil if the entry
+// is identical to the file, having read all of it. Otherwise it returns what
+// was read, for copyEntry to write the entry without reading it again.
+func compareEntry(name string, mode os.FileMode, size int64, r io.Reader) (*partialEntry, error) {
+	fi, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return &partialEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm() != mode || fi.Size() != size {
+		return &partialEntry{}, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entry := &partialEntry{existing: name}
+	buf := make([]byte, 32<<10)
+	existing := make([]byte, len(buf))
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, ferr := io.ReadFull(f, existing[:n]); ferr != nil || !bytes.Equal(buf[:n], existing[:n]) {
+				entry.pending = append([]byte(nil), buf[:n]...)
+				return entry, nil
+			}
+			entry.matched += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if entry.matched != size {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// copyEntry writes the contents of entry to w: the bytes it matched, read
+// again from the existing file, the pending bytes and then the rest of r.
+func copyEntry(w io.Writer, entry *partialEntry, r io.Reader) (int64, error) {
+	var written int64
+	if entry.matched > 0 {
+		f, err := os.Open(entry.existing)
+		if err != nil {
+			return written, err
+		}
+		n, err := io.CopyN(w, f, entry.matched)
+		f.Close()
+		written += n
+		if err != nil {
+			return written, err
 		}
 	}
+	n, err := w.Write(entry.pending)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	rest, err := io.Copy(w, r)
+	return written + rest, err
+}
+
+// entryPath returns the cleaned, slash-separated absolute path of a tar
+// entry, regardless of the separators used when the archive was written.
+func entryPath(name string) string {
+	return path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
 }
 
-func releaseName(ref name.Reference) string {
-	if t, ok := ref.(*name.Tag); ok && releasePattern.MatchString(t.TagStr()) {
-		hash := sha256.Sum256([]byte(ref.String()))
+// releaseName returns the data dir name for ref: the tag and a hash of the
+// normalized reference for release tags matching pattern, the digest for
+// digest references, and an empty string otherwise. Runtimes staged before
+// the hash was normalized were named by a hash of the reference as written,
+// so unless that was already canonical (index.docker.io/library/...) they
+// are not found under the new name and are extracted again, once, into a
+// new data dir. The old data dir is left in place, and is still listed by
+// StagedRuntimes.
+func releaseName(ref name.Reference, pattern *regexp.Regexp) string {
+	if t, ok := ref.(name.Tag); ok && pattern.MatchString(t.TagStr()) {
+		// hash the normalized registry and repository rather than the
+		// reference as written, so that equivalent references such as
+		// image:v1 and docker.io/library/image:v1 share a data dir
+		hash := sha256.Sum256([]byte(t.Context().Name() + ":" + t.TagStr()))
 		return t.TagStr() + "-" + hex.EncodeToString(hash[:])[:12]
-	} else if d, ok := ref.(*name.Digest); ok {
+	} else if d, ok := ref.(name.Digest); ok {
 		str := d.DigestStr()
 		parts := strings.SplitN(str, ":", 2)
 		if len(parts) == 2 {
@@ -139,27 +1129,74 @@ func releaseName(ref name.Reference) string {
 	return ""
 }
 
-func extractFromDir(dir, prefix string, img v1.Image, imgName string) error {
-	if dirExists(dir) {
-		return nil
+// ExtractImageDirs extracts the top-level directories of img named by the
+// keys of dirs into the directories they map to. Relative destinations are
+// resolved against targetDir. Files are staged in a temporary directory
+// under targetDir before being moved into place, so destinations should be
+// on the same filesystem.
+func ExtractImageDirs(img v1.Image, targetDir string, dirs map[string]string) error {
+	imgName := "image"
+	if digest, err := img.Digest(); err == nil {
+		imgName = digest.String()
+	}
+
+	dests := make(map[string]string, len(dirs))
+	for src, dest := range dirs {
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join(targetDir, dest)
+		}
+		dests[src] = dest
 	}
 
-	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
-		return err
+	_, err := extractToDirs(img, imgName, targetDir, dests, nil, StageOptions{})
+	return err
+}
+
+// extractToDirs extracts the top-level image directories named by the keys
+// of dirs into the directories they map to. Everything is extracted into a
+// temporary directory under tempBase first and only then moved into place, so
+// tempBase must be on the same filesystem as the destinations. If
+// opts.ValidateBinaries is set, nothing is moved unless the extracted bin dir
+// holds valid binaries. previous is as for StageOptions.extractOptions.
+func extractToDirs(img v1.Image, imgName, tempBase string, dirs, previous map[string]string, opts StageOptions) (extractStats, error) {
+	stats := newExtractStats()
+	if err := os.MkdirAll(tempBase, 0755); err != nil {
+		return stats, err
 	}
 
-	tempDir, err := ioutil.TempDir(filepath.Split(dir))
+	tempDir, err := ioutil.TempDir(tempBase, "runtime-*")
 	if err != nil {
-		return err
+		return stats, err
 	}
 	defer os.RemoveAll(tempDir)
 
-	r := mutate.Extract(img)
-	defer r.Close()
+	stats, err = extractImage(imgName, tempDir, img, opts.extractOptions(dirs, previous))
+	if err != nil {
+		return stats, err
+	}
+	for src := range dirs {
+		if !stats.found[src] {
+			return stats, fmt.Errorf("runtime image missing expected %s directory", src)
+		}
+	}
+	if binDir, ok := dirs["bin"]; ok && opts.ValidateBinaries {
+		if err := validateBinaries(filepath.Join(tempDir, "bin")); err != nil {
+			return stats, &ValidationError{BinDir: binDir, Err: err}
+		}
+	}
 
-	// extracting manifests
-	if err := extract(imgName, tempDir, prefix, r); err != nil {
-		return err
+	// check every destination first, so that a conflict leaves them all as
+	// they were
+	for src, dest := range dirs {
+		if err := checkOverwrite(filepath.Join(tempDir, src), dest, opts); err != nil {
+			return stats, err
+		}
+	}
+	var errs []error
+	for src, dest := range dirs {
+		if err := moveDir(filepath.Join(tempDir, src), dest, opts); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	return os.Rename(tempDir, dir)
+	return stats, merr.NewErrors(errs...)
 }
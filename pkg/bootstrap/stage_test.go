@@ -0,0 +1,641 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/rancher/rke2/pkg/images"
+	"github.com/sirupsen/logrus"
+)
+
+const testRuntime = "rancher/rke2-runtime:v1.18.4"
+
+var testImages = images.Images{Runtime: testRuntime}
+
+func TestStageBinDirMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not kept on Windows")
+	}
+	dataDir := tempDir(t)
+	result, err := StageWithResult(dataDir, testImages, StageOptions{
+		Image:      testRuntimeImage(t, testEntry{name: "bin/crictl", body: "crictl", mode: 0777}),
+		BinDirMode: 0750,
+		Logger:     testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(result.BinDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0750 {
+		t.Errorf("bin dir mode is %s, want 0750", fi.Mode().Perm())
+	}
+	for _, name := range listDir(t, result.BinDir) {
+		fi, err := os.Stat(filepath.Join(result.BinDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm()&^0750 != 0 {
+			t.Errorf("%s mode is %s, not masked by 0750", name, fi.Mode().Perm())
+		}
+	}
+}
+
+func TestStageExtraExtractPaths(t *testing.T) {
+	dataDir := tempDir(t)
+	shareDir := filepath.Join(dataDir, "share")
+	_, err := Stage(dataDir, testImages, StageOptions{
+		Image:             testRuntimeImage(t, testEntry{name: "share/README", body: "readme"}),
+		ExtraExtractPaths: map[string]string{"share": shareDir},
+		Logger:            testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(shareDir, "README")); got != "readme" {
+		t.Errorf("got %q, want readme", got)
+	}
+
+	// a directory the image does not have is an error
+	_, err = Stage(tempDir(t), testImages, StageOptions{
+		Image:             testRuntimeImage(t),
+		ExtraExtractPaths: map[string]string{"share": shareDir},
+		Logger:            testLogger(),
+	})
+	if err == nil {
+		t.Error("staged an image missing an extra directory")
+	}
+}
+
+func TestStageProvidedImage(t *testing.T) {
+	// nothing listens on the registry, so the image must not be pulled
+	result, err := StageWithResult(tempDir(t), images.Images{Runtime: "127.0.0.1:1/rancher/rke2-runtime:v1.18.4"}, StageOptions{
+		Image:  testRuntimeImage(t),
+		Logger: testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != ImageSourceProvided || !result.Extracted {
+		t.Errorf("got %+v, want a provided image to be extracted", result)
+	}
+}
+
+func TestIsStaged(t *testing.T) {
+	dataDir := tempDir(t)
+	v2 := images.Images{Runtime: "rancher/rke2-runtime:v1.18.5"}
+	isStaged := func(images images.Images) bool {
+		t.Helper()
+		staged, err := IsStaged(dataDir, images, StageOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return staged
+	}
+
+	if isStaged(testImages) {
+		t.Error("missing runtime reported as staged")
+	}
+
+	if _, err := Stage(dataDir, testImages, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()}); err != nil {
+		t.Fatal(err)
+	}
+	if !isStaged(testImages) {
+		t.Error("staged runtime not reported as staged")
+	}
+	if isStaged(v2) {
+		t.Error("other version reported as staged")
+	}
+
+	// once another version is active the first one is stale, even though
+	// its bin dir is still there
+	if _, err := Stage(dataDir, v2, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()}); err != nil {
+		t.Fatal(err)
+	}
+	if isStaged(testImages) {
+		t.Error("inactive runtime reported as staged")
+	}
+	if !isStaged(v2) {
+		t.Error("active runtime not reported as staged")
+	}
+
+	if isStaged(images.Images{Runtime: "rancher/rke2-runtime:dev"}) {
+		t.Error("non-release runtime reported as staged")
+	}
+}
+
+func TestStageReplacesBinPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, link string)
+	}{
+		{"missing", func(t *testing.T, link string) {}},
+		{"real dir", func(t *testing.T, link string) {
+			writeFile(t, filepath.Join(link, "containerd"), "old", 0755)
+		}},
+		{"stale symlink", func(t *testing.T, link string) {
+			if err := os.Symlink(filepath.Join(filepath.Dir(link), "data", "gone", "bin"), link); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := tempDir(t)
+			tt.setup(t, symlinkBinDir(dataDir))
+			binDir, err := Stage(dataDir, testImages, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target, err := os.Readlink(symlinkBinDir(dataDir)); err != nil || target != binDir {
+				t.Errorf("bin links to %q (%v), want %q", target, err, binDir)
+			}
+		})
+	}
+}
+
+func TestStageFailOnRealBinDir(t *testing.T) {
+	dataDir := tempDir(t)
+	writeFile(t, filepath.Join(symlinkBinDir(dataDir), "containerd"), "old", 0755)
+	_, err := Stage(dataDir, testImages, StageOptions{
+		Image:            testRuntimeImage(t),
+		FailOnRealBinDir: true,
+		Logger:           testLogger(),
+	})
+	if err == nil {
+		t.Fatal("replaced a real bin dir")
+	}
+	if got := readFile(t, filepath.Join(symlinkBinDir(dataDir), "containerd")); got != "old" {
+		t.Errorf("real bin dir was modified")
+	}
+}
+
+func TestLinkBinDirError(t *testing.T) {
+	// neither the bin symlink nor the active bin dir record can be created
+	// under a data dir that is a file
+	dataDir := filepath.Join(tempDir(t), "data-dir")
+	writeFile(t, dataDir, "", 0644)
+	if err := linkBinDir(dataDir, filepath.Join(tempDir(t), "bin"), StageOptions{Logger: testLogger()}); err == nil {
+		t.Error("link failure was not returned")
+	}
+}
+
+func TestStageWhiteoutsAndDuplicates(t *testing.T) {
+	dataDir := tempDir(t)
+	img := testImage(t,
+		testLayer(t, append(testBinaries(),
+			testEntry{name: "charts/rke2-canal.yaml", body: "canal"},
+			testEntry{name: "charts/rke2-coredns.yaml", body: "coredns"},
+		)...),
+		testLayer(t,
+			testEntry{name: "charts/.wh.rke2-canal.yaml"},
+			testEntry{name: "charts/rke2-coredns.yaml", body: "coredns v2"},
+			testEntry{name: "charts/rke2-coredns.yaml", body: "coredns v3"},
+		),
+	)
+	if _, err := Stage(dataDir, testImages, StageOptions{Image: img, Logger: testLogger()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := listDir(t, manifestsDir(dataDir)); len(got) != 1 || got[0] != "rke2-coredns.yaml" {
+		t.Errorf("manifests are %v, want only rke2-coredns.yaml", got)
+	}
+	if got := readFile(t, filepath.Join(manifestsDir(dataDir), "rke2-coredns.yaml")); got != "coredns v3" {
+		t.Errorf("got %q, want the last entry", got)
+	}
+}
+
+func TestStageConcurrent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("data dir locking is not supported on Windows")
+	}
+	dataDir := tempDir(t)
+	img := testRuntimeImage(t)
+
+	const n = 8
+	errs := make(chan error, n)
+	binDirs := make(chan string, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			binDir, err := Stage(dataDir, testImages, StageOptions{Image: img, Logger: testLogger()})
+			errs <- err
+			binDirs <- binDir
+		}()
+	}
+
+	var first string
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+		binDir := <-binDirs
+		if first == "" {
+			first = binDir
+		} else if binDir != first {
+			t.Errorf("got bin dir %s, want %s", binDir, first)
+		}
+	}
+	if err := validateBinaries(first); err != nil {
+		t.Error(err)
+	}
+	if got := listDir(t, manifestsDir(dataDir)); len(got) != 1 {
+		t.Errorf("manifests are %v", got)
+	}
+}
+
+func TestStageWithResult(t *testing.T) {
+	dataDir := tempDir(t)
+	opts := StageOptions{Image: testRuntimeImage(t), Logger: testLogger()}
+
+	first, err := StageWithResult(dataDir, testImages, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Source != ImageSourceProvided || !first.Extracted {
+		t.Errorf("first result is %+v, want a provided image to be extracted", first)
+	}
+
+	second, err := StageWithResult(dataDir, testImages, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Source != ImageSourceStaged || second.Extracted || second.BinDir != first.BinDir {
+		t.Errorf("second result is %+v, want %s to be reused", second, first.BinDir)
+	}
+}
+
+func TestStageLogsToLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.Out = buf
+	if _, err := Stage(tempDir(t), testImages, StageOptions{
+		Image:  testRuntimeImage(t),
+		Logger: logger.WithField("boot", "test-boot"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "boot=test-boot") {
+		t.Errorf("log is missing the caller's fields:\n%s", buf)
+	}
+}
+
+func TestStageMissingCharts(t *testing.T) {
+	dataDir := tempDir(t)
+	_, err := Stage(dataDir, testImages, StageOptions{
+		Image:  testImage(t, testLayer(t, testBinaries()...)),
+		Logger: testLogger(),
+	})
+	if _, ok := err.(*ExtractError); !ok {
+		t.Fatalf("got error %v, want an ExtractError", err)
+	}
+	if !strings.Contains(err.Error(), "runtime image missing expected charts directory") {
+		t.Errorf("got error %v", err)
+	}
+	if staged, _ := StagedRuntimes(dataDir); len(staged) != 0 {
+		t.Errorf("runtime without charts was staged: %v", staged)
+	}
+}
+
+func BenchmarkStage(b *testing.B) {
+	img := testRuntimeImage(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := Stage(tempDir(b), testImages, StageOptions{Image: img, Logger: testLogger()}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStageStaged(b *testing.B) {
+	dataDir := tempDir(b)
+	opts := StageOptions{Image: testRuntimeImage(b), Logger: testLogger()}
+	if _, err := Stage(dataDir, testImages, opts); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Stage(dataDir, testImages, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEffectiveRuntimeReferencePattern(t *testing.T) {
+	custom := regexp.MustCompile(`^release-`)
+	tests := []struct {
+		runtime string
+		pattern *regexp.Regexp
+		release bool
+	}{
+		{"rancher/rke2-runtime:v1.18.4", nil, true},
+		{"rancher/rke2-runtime:dev", nil, false},
+		{"rancher/rke2-runtime:release-1.18", nil, false},
+		{"rancher/rke2-runtime:release-1.18", custom, true},
+		{"rancher/rke2-runtime:v1.18.4", custom, false},
+	}
+	for _, tt := range tests {
+		_, dataName, err := EffectiveRuntimeReference(images.Images{Runtime: tt.runtime}, StageOptions{ReleasePattern: tt.pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if release := dataName != ""; release != tt.release {
+			t.Errorf("%s with pattern %v: got data dir name %q", tt.runtime, tt.pattern, dataName)
+		}
+	}
+
+	if _, _, err := EffectiveRuntimeReference(images.Images{Runtime: "Not A Reference"}, StageOptions{}); err == nil {
+		t.Error("invalid reference accepted")
+	}
+}
+
+func TestStageSkipUnchanged(t *testing.T) {
+	dataDir := tempDir(t)
+	manifests := manifestsDir(dataDir)
+	if _, err := Stage(dataDir, testImages, StageOptions{
+		Image:  testRuntimeImage(t, testEntry{name: "charts/rke2-coredns.yaml", body: "coredns"}),
+		Logger: testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(manifests, "rke2-canal.yaml"), "edited", 0644)
+
+	stat := func(name string) os.FileInfo {
+		t.Helper()
+		fi, err := os.Stat(filepath.Join(manifests, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+	canal, coredns := stat("rke2-canal.yaml"), stat("rke2-coredns.yaml")
+
+	// the earlier layer has another version of the unchanged chart, which
+	// must not replace it
+	img := testImage(t,
+		testLayer(t, testEntry{name: "charts/rke2-coredns.yaml", body: "old"}),
+		testLayer(t, append(testBinaries(),
+			testEntry{name: "charts/rke2-canal.yaml", body: "canal"},
+			testEntry{name: "charts/rke2-coredns.yaml", body: "coredns"},
+		)...),
+	)
+	if _, err := Stage(dataDir, images.Images{Runtime: "rancher/rke2-runtime:v1.18.5"}, StageOptions{
+		Image:         img,
+		SkipUnchanged: true,
+		Logger:        testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, filepath.Join(manifests, "rke2-canal.yaml")); got != "canal" {
+		t.Errorf("changed chart is %q, want canal", got)
+	}
+	if os.SameFile(canal, stat("rke2-canal.yaml")) {
+		t.Error("changed chart was not replaced")
+	}
+	if got := readFile(t, filepath.Join(manifests, "rke2-coredns.yaml")); got != "coredns" {
+		t.Errorf("unchanged chart is %q, want coredns", got)
+	}
+	if !os.SameFile(coredns, stat("rke2-coredns.yaml")) {
+		t.Error("unchanged chart was replaced")
+	}
+}
+
+func TestEffectiveRuntimeReference(t *testing.T) {
+	dataDir := tempDir(t)
+	ref, dataName, err := EffectiveRuntimeReference(testImages, StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Name() != "index.docker.io/"+testRuntime {
+		t.Errorf("got reference %s", ref)
+	}
+	result, err := StageWithResult(dataDir, testImages, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dataDirFor(dataDir, dataName); got != result.BinDir {
+		t.Errorf("reported data dir %s, staged into %s", got, result.BinDir)
+	}
+
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	ref, dataName, err = EffectiveRuntimeReference(images.Images{Runtime: "rancher/rke2-runtime@" + digest}, StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Identifier() != digest || dataName != strings.Repeat("ab", 32) {
+		t.Errorf("got reference %s and data dir name %q", ref, dataName)
+	}
+}
+
+func TestStageTempDir(t *testing.T) {
+	dataDir := tempDir(t)
+	temp := filepath.Join(tempDir(t), "tmp")
+	var during []string
+	if _, err := Stage(dataDir, testImages, StageOptions{
+		Image:   testRuntimeImage(t),
+		TempDir: temp,
+		HeaderHook: func(h *tar.Header) (*tar.Header, bool, error) {
+			if during == nil {
+				during = listDir(t, temp)
+			}
+			return h, true, nil
+		},
+		Logger: testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	used := false
+	for _, name := range during {
+		used = used || strings.HasPrefix(name, "runtime-")
+	}
+	if !used {
+		t.Errorf("temp dir held %v during extraction, want the runtime temp dir", during)
+	}
+	if got := listDir(t, temp); len(got) != 0 {
+		t.Errorf("temp dir left with %v", got)
+	}
+
+	// a temp dir that cannot be created falls back to the data dir
+	writeFile(t, filepath.Join(dataDir, "file"), "", 0644)
+	if got := (StageOptions{TempDir: filepath.Join(dataDir, "file", "tmp"), Logger: testLogger()}).tempBase(dataDir); got != dataDir {
+		t.Errorf("got temp base %s, want %s", got, dataDir)
+	}
+}
+
+func TestStageFallbackToStaged(t *testing.T) {
+	dataDir := tempDir(t)
+	first, err := StageWithResult(dataDir, testImages, StageOptions{Image: testRuntimeImage(t), Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing listens on the registry
+	unreachable := images.Images{Runtime: "127.0.0.1:1/rancher/rke2-runtime:v1.18.5"}
+	if _, err := Stage(dataDir, unreachable, StageOptions{Logger: testLogger()}); err == nil {
+		t.Fatal("pulled from a dead registry")
+	}
+	result, err := StageWithResult(dataDir, unreachable, StageOptions{FallbackToStaged: true, Logger: testLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != ImageSourceStaged || result.BinDir != first.BinDir {
+		t.Errorf("got %+v, want a fallback to %s", result, first.BinDir)
+	}
+
+	// a staged runtime with broken binaries is not fallen back to
+	writeFile(t, filepath.Join(first.BinDir, requiredBinaries[0]), "broken", 0755)
+	if _, err := Stage(dataDir, unreachable, StageOptions{FallbackToStaged: true, Logger: testLogger()}); err == nil {
+		t.Error("fell back to a runtime with broken binaries")
+	}
+}
+
+func TestStageLogProgress(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.Out = buf
+	img := testImage(t,
+		testLayer(t, testBinaries()...),
+		testLayer(t, testEntry{name: "charts/rke2-canal.yaml", body: "canal"}),
+	)
+	if _, err := Stage(tempDir(t), testImages, StageOptions{
+		Image:       img,
+		LogProgress: true,
+		Logger:      logrus.NewEntry(logger),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"layer 1/2", "layer 2/2"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log is missing progress for %s:\n%s", want, buf)
+		}
+	}
+}
+
+func TestStageManifestsDir(t *testing.T) {
+	dataDir := tempDir(t)
+	manifests := filepath.Join(tempDir(t), "manifests")
+	if _, err := Stage(dataDir, testImages, StageOptions{
+		Image:        testRuntimeImage(t),
+		ManifestsDir: manifests,
+		Logger:       testLogger(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(manifests, "rke2-canal.yaml")); got != "canal" {
+		t.Errorf("got %q, want canal", got)
+	}
+	if _, err := os.Stat(manifestsDir(dataDir)); !os.IsNotExist(err) {
+		t.Errorf("default manifests dir was created: %v", err)
+	}
+}
+
+func TestStageRecoversPartialRuntime(t *testing.T) {
+	dataDir := tempDir(t)
+	opts := StageOptions{Image: testRuntimeImage(t), ValidateBinaries: true, Logger: testLogger()}
+	first, err := StageWithResult(dataDir, testImages, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, damage := range []func(){
+		// the charts are still there, but the bin dir is not
+		func() { os.RemoveAll(first.BinDir) },
+		func() { os.RemoveAll(manifestsDir(dataDir)) },
+		func() { writeFile(t, filepath.Join(first.BinDir, requiredBinaries[0]), "broken", 0755) },
+	} {
+		damage()
+		result, err := StageWithResult(dataDir, testImages, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Extracted {
+			t.Errorf("damaged runtime was reused: %+v", result)
+		}
+		if err := validateBinaries(result.BinDir); err != nil {
+			t.Error(err)
+		}
+		if got := readFile(t, filepath.Join(manifestsDir(dataDir), "rke2-canal.yaml")); got != "canal" {
+			t.Errorf("got chart %q, want canal", got)
+		}
+	}
+}
+
+func TestReleaseNameNormalized(t *testing.T) {
+	releaseNameOf := func(image string) string {
+		t.Helper()
+		_, dataName, err := EffectiveRuntimeReference(images.Images{Runtime: image}, StageOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dataName
+	}
+
+	want := releaseNameOf("image:v1.18.4")
+	for _, image := range []string{"docker.io/library/image:v1.18.4", "index.docker.io/library/image:v1.18.4"} {
+		if got := releaseNameOf(image); got != want {
+			t.Errorf("%s has data dir name %s, want %s as for image:v1.18.4", image, got, want)
+		}
+	}
+
+	// a registry port makes a different registry
+	names := map[string]bool{want: true}
+	for _, image := range []string{"registry.example.com/image:v1.18.4", "registry.example.com:5000/image:v1.18.4"} {
+		got := releaseNameOf(image)
+		if names[got] {
+			t.Errorf("%s shares data dir name %s with another registry", image, got)
+		}
+		names[got] = true
+	}
+}
+
+func TestStageSkipUnchangedBinaries(t *testing.T) {
+	dataDir := tempDir(t)
+	first, err := Stage(dataDir, testImages, StageOptions{
+		Image:  testRuntimeImage(t, testEntry{name: "bin/crictl", body: "v1", mode: 0755}),
+		Logger: testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Stage(dataDir, images.Images{Runtime: "rancher/rke2-runtime:v1.18.5"}, StageOptions{
+		Image:            testRuntimeImage(t, testEntry{name: "bin/crictl", body: "v2", mode: 0755}),
+		SkipUnchanged:    true,
+		ValidateBinaries: true,
+		Logger:           testLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := listDir(t, second), listDir(t, first); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got binaries %v, want %v", got, want)
+	}
+	for _, name := range listDir(t, second) {
+		a, err := os.Stat(filepath.Join(first, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(filepath.Join(second, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rewritten, want := !os.SameFile(a, b), name == "crictl"; rewritten != want {
+			t.Errorf("%s rewritten: %v, want %v", name, rewritten, want)
+		}
+	}
+	if got := readFile(t, filepath.Join(second, "crictl")); got != "v2" {
+		t.Errorf("new crictl is %q, want v2", got)
+	}
+	if got := readFile(t, filepath.Join(first, "crictl")); got != "v1" {
+		t.Errorf("old crictl is %q, want v1", got)
+	}
+}
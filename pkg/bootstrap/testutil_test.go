@@ -0,0 +1,162 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/sirupsen/logrus"
+)
+
+// testEntry is an entry in a test layer. Entries without a type are regular
+// files, and entries without a mode get 0644.
+type testEntry struct {
+	name     string
+	body     string
+	mode     int64
+	typeflag byte
+	linkname string
+}
+
+// testBinary is a test entry for an executable in the bin dir.
+func testBinary(name string) testEntry {
+	return testEntry{name: "bin/" + name, body: string(binaryMagic) + name, mode: 0755}
+}
+
+// testBinaries are entries for the binaries validateBinaries requires.
+func testBinaries() []testEntry {
+	var entries []testEntry
+	for _, name := range requiredBinaries {
+		entries = append(entries, testBinary(name))
+	}
+	return entries
+}
+
+func testTar(t testing.TB, entries ...testEntry) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		h := &tar.Header{
+			Name:     e.name,
+			Mode:     e.mode,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+		}
+		if h.Mode == 0 {
+			h.Mode = 0644
+		}
+		if h.Typeflag == 0 {
+			h.Typeflag = tar.TypeReg
+		}
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(e.body))
+		}
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testLayer(t testing.TB, entries ...testEntry) v1.Layer {
+	t.Helper()
+	data := testTar(t, entries...)
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+func testImage(t testing.TB, layers ...v1.Layer) v1.Image {
+	t.Helper()
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// testRuntimeImage returns an image holding valid runtime binaries and a
+// chart, plus any extra entries.
+func testRuntimeImage(t testing.TB, extra ...testEntry) v1.Image {
+	t.Helper()
+	entries := append(testBinaries(), testEntry{name: "charts/rke2-canal.yaml", body: "canal"})
+	return testImage(t, testLayer(t, append(entries, extra...)...))
+}
+
+func testExtractOptions(dirs ...string) extractOptions {
+	m := map[string]string{}
+	for _, dir := range dirs {
+		m[dir] = ""
+	}
+	return StageOptions{Logger: testLogger()}.extractOptions(m, nil)
+}
+
+func testLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logrus.NewEntry(logger)
+}
+
+func tempDir(t testing.TB) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bootstrap-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// listDir returns the names of the files in dir, sorted.
+func listDir(t testing.TB, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readFile(t testing.TB, name string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func writeFile(t testing.TB, name, body string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(body), mode); err != nil {
+		t.Fatal(err)
+	}
+}
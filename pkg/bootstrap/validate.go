@@ -0,0 +1,77 @@
+package bootstrap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// checkPlatform compares the OS and architecture img was built for with the
+// ones this process is running on. A mismatch is logged as a warning, or
+// returned as an error if opts.FailOnPlatformMismatch is set.
+func checkPlatform(img v1.Image, opts StageOptions) error {
+	config, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	if config.OS == "" && config.Architecture == "" {
+		return nil
+	}
+	if config.OS == runtime.GOOS && config.Architecture == runtime.GOARCH {
+		return nil
+	}
+
+	msg := fmt.Sprintf("runtime image is built for %s/%s but this node is %s/%s; extracted binaries will not run",
+		config.OS, config.Architecture, runtime.GOOS, runtime.GOARCH)
+	if opts.FailOnPlatformMismatch {
+		return errors.New(msg)
+	}
+	opts.logger().Warn(msg)
+	return nil
+}
+
+// validateBinaries checks that the required binaries in binDir are
+// non-empty executables for the current platform.
+func validateBinaries(binDir string) error {
+	for _, name := range requiredBinaries {
+		if err := validateBinary(filepath.Join(binDir, name), binaryMagic); err != nil {
+			return errors.Wrapf(err, "invalid runtime binary %s", name)
+		}
+	}
+	return nil
+}
+
+// validateBinary checks that the file at path is executable and starts with
+// magic.
+func validateBinary(path string, magic []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := checkExecutable(fi); err != nil {
+		return err
+	}
+
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(f, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("file is empty or truncated")
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(header, magic) {
+		return fmt.Errorf("unexpected file signature %x", header)
+	}
+	return nil
+}
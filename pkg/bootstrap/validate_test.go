@@ -0,0 +1,93 @@
+package bootstrap
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/rancher/rke2/pkg/images"
+)
+
+func writeBinaries(t *testing.T, binDir string) {
+	t.Helper()
+	for _, name := range requiredBinaries {
+		writeFile(t, filepath.Join(binDir, name), string(binaryMagic)+name, 0755)
+	}
+}
+
+func TestValidateBinaries(t *testing.T) {
+	binDir := tempDir(t)
+	writeBinaries(t, binDir)
+	if err := validateBinaries(binDir); err != nil {
+		t.Fatalf("valid binaries: %v", err)
+	}
+
+	name := filepath.Join(binDir, requiredBinaries[0])
+	writeFile(t, name, "#!/bin/sh", 0755)
+	if err := validateBinaries(binDir); err == nil {
+		t.Error("binary with the wrong signature passed")
+	}
+	writeFile(t, name, "", 0755)
+	if err := validateBinaries(binDir); err == nil {
+		t.Error("empty binary passed")
+	}
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateBinaries(binDir); err == nil {
+		t.Error("missing binary passed")
+	}
+}
+
+func TestValidateBinariesNotExecutable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes do not control execution on Windows")
+	}
+	binDir := tempDir(t)
+	writeBinaries(t, binDir)
+	if err := os.Chmod(filepath.Join(binDir, requiredBinaries[0]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateBinaries(binDir); err == nil {
+		t.Error("non-executable binary passed")
+	}
+}
+
+func TestStageValidatesBeforeMoving(t *testing.T) {
+	entries := []testEntry{{name: "charts/rke2-canal.yaml", body: "canal"}}
+	for _, e := range testBinaries() {
+		e.body = "not a binary"
+		entries = append(entries, e)
+	}
+
+	dataDir := tempDir(t)
+	_, err := Stage(dataDir, images.Images{Runtime: "rancher/rke2-runtime:v1.18.4"}, StageOptions{
+		Image:            testImage(t, testLayer(t, entries...)),
+		ValidateBinaries: true,
+		Logger:           testLogger(),
+	})
+	if _, ok := err.(*ValidationError); !ok {
+		t.Fatalf("got error %v, want a ValidationError", err)
+	}
+	if _, err := os.Stat(filepath.Join(manifestsDir(dataDir), "rke2-canal.yaml")); !os.IsNotExist(err) {
+		t.Errorf("chart was moved into place before validation: %v", err)
+	}
+	if staged, _ := StagedRuntimes(dataDir); len(staged) != 0 {
+		t.Errorf("invalid runtime was staged: %v", staged)
+	}
+}
+
+func TestCheckPlatform(t *testing.T) {
+	if err := checkPlatform(platformImage(t, runtime.GOOS, runtime.GOARCH), StageOptions{FailOnPlatformMismatch: true}); err != nil {
+		t.Errorf("matching platform: %v", err)
+	}
+
+	other := platformImage(t, "plan9", runtime.GOARCH)
+	if err := checkPlatform(other, StageOptions{Logger: testLogger()}); err != nil {
+		t.Errorf("mismatch without FailOnPlatformMismatch: %v", err)
+	}
+	if err := checkPlatform(other, StageOptions{FailOnPlatformMismatch: true}); err == nil {
+		t.Error("mismatch with FailOnPlatformMismatch passed")
+	}
+}
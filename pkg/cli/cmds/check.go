@@ -0,0 +1,31 @@
+package cmds
+
+import (
+	"github.com/rancher/k3s/pkg/cli/cmds"
+	"github.com/rancher/rke2/pkg/rke2"
+	"github.com/rancher/spur/cli"
+)
+
+var (
+	k3sCheckRuntimeBase = mustCmdFromK3S(cmds.NewAgentCommand(CheckRuntimeRun), checkRuntimeFlagOpts())
+)
+
+// checkRuntimeFlagOpts returns the flag options of check-runtime, which
+// only reads the data dir and so never needs registry configuration.
+func checkRuntimeFlagOpts() map[string]*K3SFlagOption {
+	opts := runtimeFlagOpts()
+	opts["private-registry"] = drop
+	return opts
+}
+
+func NewCheckRuntimeCommand() *cli.Command {
+	cmd := k3sCheckRuntimeBase
+	cmd.Name = "check-runtime"
+	cmd.Usage = "Verify the runtime binaries and charts staged in the data dir"
+	cmd.Flags = append(cmd.Flags, commonFlag...)
+	return cmd
+}
+
+func CheckRuntimeRun(ctx *cli.Context) error {
+	return rke2.CheckRuntime(ctx, config)
+}
@@ -0,0 +1,13 @@
+package cmds
+
+import "testing"
+
+func TestCheckRuntimeFlags(t *testing.T) {
+	flags := flagNames(NewCheckRuntimeCommand())
+	if !flags["data-dir"] {
+		t.Error("check-runtime is missing --data-dir")
+	}
+	if flags["private-registry"] {
+		t.Error("check-runtime has --private-registry")
+	}
+}
@@ -0,0 +1,64 @@
+package cmds
+
+import (
+	"github.com/rancher/k3s/pkg/cli/cmds"
+	"github.com/rancher/rke2/pkg/rke2"
+	"github.com/rancher/spur/cli"
+)
+
+var (
+	k3sPrepareRuntimeBase = mustCmdFromK3S(cmds.NewAgentCommand(PrepareRuntimeRun), runtimeFlagOpts())
+)
+
+// runtimeFlagOpts returns the k3s agent flag options of the commands that
+// work on the staged runtime without starting RKE2.
+func runtimeFlagOpts() map[string]*K3SFlagOption {
+	return map[string]*K3SFlagOption{
+		"config":          copy,
+		"debug":           copy,
+		"v":               hide,
+		"vmodule":         hide,
+		"log":             hide,
+		"alsologtostderr": hide,
+		"data-dir": {
+			Usage:   "(data) Folder to hold state",
+			Default: rke2Path,
+		},
+		"token":                      drop,
+		"token-file":                 drop,
+		"disable-selinux":            drop,
+		"node-name":                  drop,
+		"with-node-id":               drop,
+		"node-label":                 drop,
+		"node-taint":                 drop,
+		"docker":                     drop,
+		"container-runtime-endpoint": drop,
+		"pause-image":                drop,
+		"private-registry":           copy,
+		"node-ip":                    drop,
+		"node-external-ip":           drop,
+		"resolv-conf":                drop,
+		"flannel-iface":              drop,
+		"flannel-conf":               drop,
+		"kubelet-arg":                drop,
+		"kube-proxy-arg":             drop,
+		"rootless":                   drop,
+		"server":                     drop,
+		"no-flannel":                 drop,
+		"cluster-secret":             drop,
+		"protect-kernel-defaults":    drop,
+		"snapshotter":                drop,
+	}
+}
+
+func NewPrepareRuntimeCommand() *cli.Command {
+	cmd := k3sPrepareRuntimeBase
+	cmd.Name = "prepare-runtime"
+	cmd.Usage = "Stage the runtime binaries and charts without starting RKE2"
+	cmd.Flags = append(cmd.Flags, commonFlag...)
+	return cmd
+}
+
+func PrepareRuntimeRun(ctx *cli.Context) error {
+	return rke2.PrepareRuntime(ctx, config)
+}
@@ -0,0 +1,31 @@
+package cmds
+
+import (
+	"testing"
+
+	"github.com/rancher/spur/cli"
+)
+
+func flagNames(cmd *cli.Command) map[string]bool {
+	names := map[string]bool{}
+	for _, flag := range cmd.Flags {
+		for _, name := range cli.FlagNames(flag) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func TestPrepareRuntimeFlags(t *testing.T) {
+	flags := flagNames(NewPrepareRuntimeCommand())
+	for _, name := range []string{"config", "data-dir", "private-registry"} {
+		if !flags[name] {
+			t.Errorf("prepare-runtime is missing --%s", name)
+		}
+	}
+	for _, name := range []string{"token", "server", "node-name"} {
+		if flags[name] {
+			t.Errorf("prepare-runtime has --%s", name)
+		}
+	}
+}
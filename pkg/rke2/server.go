@@ -1,6 +1,7 @@
 package rke2
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,6 +18,7 @@ import (
 	"github.com/rancher/rke2/pkg/images"
 	"github.com/rancher/rke2/pkg/podexecutor"
 	"github.com/rancher/spur/cli"
+	"github.com/sirupsen/logrus"
 )
 
 type Config struct {
@@ -43,6 +45,40 @@ func Agent(ctx *cli.Context, cfg Config) error {
 	return agent.Run(ctx)
 }
 
+// PrepareRuntime stages the runtime image into the data dir without
+// starting the server or agent, so that a later start does not need to.
+func PrepareRuntime(ctx *cli.Context, cfg Config) error {
+	dataDir := ctx.String("data-dir")
+	binDir, err := bootstrap.Stage(dataDir, images.New(cfg.Repo), bootstrap.StageOptions{
+		ValidateBinaries: true,
+		PrivateRegistry:  ctx.String("private-registry"),
+	})
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Runtime staged in %s", binDir)
+	return nil
+}
+
+// CheckRuntime verifies the runtime staged in the data dir, printing the
+// outcome of each check, and fails if any of them did.
+func CheckRuntime(ctx *cli.Context, cfg Config) error {
+	dataDir := ctx.String("data-dir")
+	failed := 0
+	for _, result := range bootstrap.CheckRuntime(dataDir, images.New(cfg.Repo), bootstrap.StageOptions{}) {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", result.Name, result.Err)
+		} else {
+			fmt.Printf("PASS %s\n", result.Name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d runtime checks failed for %s", failed, dataDir)
+	}
+	return nil
+}
+
 func setup(ctx *cli.Context, cfg Config) error {
 	var dataDir string
 	for _, f := range ctx.Command.Flags {
@@ -59,7 +95,10 @@ func setup(ctx *cli.Context, cfg Config) error {
 		return err
 	}
 
-	execPath, err := bootstrap.Stage(dataDir, images)
+	execPath, err := bootstrap.Stage(dataDir, images, bootstrap.StageOptions{
+		ValidateBinaries: true,
+		PrivateRegistry:  ctx.String("private-registry"),
+	})
 	if err != nil {
 		return err
 	}